@@ -3,20 +3,25 @@
 package termbox
 
 import (
-	"fmt"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
-	"runtime"
-	"syscall"
+	"strconv"
 	"time"
-
-	"github.com/mattn/go-runewidth"
 )
 
 // public API
 
 // Initializes termbox library. This function should be called before any other functions.
 // After successful initialization, the library must be finalized using 'Close' function.
+// The output mode is chosen according to the terminal's capabilities: OutputRGB
+// if COLORTERM says it supports true color, Output256 if it supports 256
+// colors and OutputNormal otherwise. Use SetOutputMode to override it.
+// Errors say which step of the initialization failed and wrap the underlying
+// error, so it can be examined with errors.Is or errors.As.
 //
 // Example usage:
 //      err := termbox.Init()
@@ -25,99 +30,55 @@ import (
 //      }
 //      defer termbox.Close()
 func Init() error {
-	var err error
-
-	if runtime.GOOS == "openbsd" || runtime.GOOS == "freebsd" {
-		out, err = os.OpenFile("/dev/tty", os.O_RDWR, 0)
-		if err != nil {
-			return err
-		}
-		in = int(out.Fd())
-	} else {
-		out, err = os.OpenFile("/dev/tty", os.O_WRONLY, 0)
-		if err != nil {
-			return err
-		}
-		in, err = syscall.Open("/dev/tty", syscall.O_RDONLY, 0)
-		if err != nil {
-			return err
-		}
-	}
-
-	err = setup_term()
-	if err != nil {
-		return fmt.Errorf("termbox: error while reading terminfo data: %v", err)
-	}
-
-	signal.Notify(sigwinch, syscall.SIGWINCH)
-	signal.Notify(sigio, syscall.SIGIO)
+	return InitWithOptions(InitOptions{})
+}
 
-	_, err = fcntl(in, syscall.F_SETFL, syscall.O_ASYNC|syscall.O_NONBLOCK)
-	if err != nil {
-		return err
-	}
-	_, err = fcntl(in, syscall.F_SETOWN, syscall.Getpid())
-	if runtime.GOOS != "darwin" && err != nil {
-		return err
-	}
-	err = tcgetattr(out.Fd(), &orig_tios)
+// Same as Init, but allows to change the settings which have to be chosen
+// before the terminal is set up, see InitOptions.
+func InitWithOptions(opts InitOptions) error {
+	err := open_tty()
 	if err != nil {
 		return err
 	}
 
-	tios := orig_tios
-	tios.Iflag &^= syscall_IGNBRK | syscall_BRKINT | syscall_PARMRK |
-		syscall_ISTRIP | syscall_INLCR | syscall_IGNCR |
-		syscall_ICRNL | syscall_IXON
-	tios.Lflag &^= syscall_ECHO | syscall_ECHONL | syscall_ICANON |
-		syscall_ISIG | syscall_IEXTEN
-	tios.Cflag &^= syscall_CSIZE | syscall_PARENB
-	tios.Cflag |= syscall_CS8
-	tios.Cc[syscall_VMIN] = 1
-	tios.Cc[syscall_VTIME] = 0
+	return init_term(opts)
+}
 
-	err = tcsetattr(out.Fd(), &tios)
+// Initializes termbox library using the given files for input and output
+// instead of the controlling terminal, e.g. the slave side of a pseudo-terminal.
+// Both files must refer to a terminal. The files are duplicated, 'Close' does
+// not close the originals.
+func InitWithFiles(in_file, out_file *os.File) error {
+	return InitWithFilesOptions(in_file, out_file, InitOptions{})
+}
+
+// Same as InitWithFiles, but allows to change the settings which have to be
+// chosen before the terminal is set up, see InitOptions.
+func InitWithFilesOptions(in_file, out_file *os.File, opts InitOptions) error {
+	err := dup_files(in_file.Fd(), out_file.Fd(), out_file.Name())
 	if err != nil {
 		return err
 	}
 
-	out.WriteString(funcs[t_enter_ca])
-	out.WriteString(funcs[t_enter_keypad])
-	out.WriteString(funcs[t_hide_cursor])
-	out.WriteString(funcs[t_clear_screen])
-
-	termw, termh = get_term_size(out.Fd())
-	back_buffer.init(termw, termh)
-	front_buffer.init(termw, termh)
-	back_buffer.clear()
-	front_buffer.clear()
+	return init_term(opts)
+}
 
-	go func() {
-		buf := make([]byte, 128)
-		for {
-			select {
-			case <-sigio:
-				for {
-					n, err := syscall.Read(in, buf)
-					if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
-						break
-					}
-					select {
-					case input_comm <- input_event{buf[:n], err}:
-						ie := <-input_comm
-						buf = ie.data[:128]
-					case <-quit:
-						return
-					}
-				}
-			case <-quit:
-				return
-			}
-		}
-	}()
+// Initializes termbox library in headless mode: the output goes to 'w' as if it
+// was an xterm of the given size, no terminal is involved. There's no input in
+// this mode, PollEvent only returns EventInterrupt. Useful for testing the
+// rendering, e.g. by comparing the escape sequences written to a bytes.Buffer.
+// The library must be finalized using 'Close' function, it doesn't close 'w'.
+func InitWithWriter(w io.Writer, width, height int) error {
+	return init_headless(w, width, height)
+}
 
-	IsInit = true
-	return nil
+// Initializes termbox library for testing: the buffers have the given fixed
+// size, no terminal is involved and the output is discarded. Events can be
+// fed to PollEvent using InjectEvent, and the contents of the screen can be
+// read back using CellBuffer or GetCell. The library must be finalized using
+// 'Close' function.
+func InitMock(width, height int) error {
+	return init_headless(ioutil.Discard, width, height)
 }
 
 // Interrupt an in-progress call to PollEvent by causing it to return
@@ -129,126 +90,344 @@ func Interrupt() {
 
 // Finalizes termbox library, should be called after successful initialization
 // when termbox's functionality isn't required anymore.
+// Calling it again, or without initialization, does nothing.
 func Close() {
-	quit <- 1
-	out.WriteString(funcs[t_show_cursor])
-	out.WriteString(funcs[t_sgr0])
-	out.WriteString(funcs[t_clear_screen])
-	out.WriteString(funcs[t_exit_ca])
-	out.WriteString(funcs[t_exit_keypad])
-	out.WriteString(funcs[t_exit_mouse])
-	tcsetattr(out.Fd(), &orig_tios)
-
-	out.Close()
-	syscall.Close(in)
+	stop_events()
+	drop_injected()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !IsInit {
+		return
+	}
+	stop_close_signals()
+	if !suspended {
+		leave_term()
+	}
+	if title_pushed {
+		out.WriteString(ti_pop_title)
+	}
+	if palette_set {
+		out.WriteString(ti_reset_palette)
+	}
+	if default_set {
+		out.WriteString(ti_reset_default_fg)
+		out.WriteString(ti_reset_default_bg)
+	}
+	if !headless {
+		signal.Stop(sigwinch)
+		signal.Stop(sigio)
+		close_files()
+	} else {
+		out.Close()
+	}
 
 	// reset the state, so that on next Init() it will work again
 	termw = 0
 	termh = 0
 	input_mode = InputEsc
+	esc_delay = default_esc_delay
+	inbuf = inbuf[:0]
 	out = nil
 	in = 0
+	headless = false
+	size_reported = false
 	lastfg = attr_invalid
 	lastbg = attr_invalid
 	lastx = coord_invalid
 	lasty = coord_invalid
 	cursor_x = cursor_hidden
 	cursor_y = cursor_hidden
+	cursor_style = CursorDefault
+	title_pushed = false
 	foreground = ColorDefault
 	background = ColorDefault
+	cells_exposed = false
+	resize_pending = false
+	suspended = false
+	keypad_app = true
+	alt_screen = true
+	linux_console = false
+	caps = TerminalCapabilities{}
+	palette_set = false
+	default_set = false
+	output_mode = OutputNormal
 	IsInit = false
 }
 
-// Synchronizes the internal back buffer with the terminal.
-func Flush() error {
-	// invalidate cursor position
-	lastx = coord_invalid
-	lasty = coord_invalid
+// Temporarily gives the terminal back, e.g. to run an editor or a shell in it:
+// leaves the alternate screen, restores the original terminal modes and stops
+// reading the input. The buffers and the settings are kept, Resume takes the
+// terminal over again. Flush does nothing while suspended, SetInputMode and
+// SetKeypadMode only record the mode, which Resume enables. Does nothing if
+// already suspended.
+func Suspend() {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !IsInit || suspended {
+		return
+	}
+	leave_term()
+	suspended = true
+}
 
-	update_size_maybe()
+// Takes the terminal over again after Suspend and redraws the whole screen.
+// Does nothing if not suspended.
+func Resume() error {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
 
-	for y := 0; y < front_buffer.height; y++ {
-		line_offset := y * front_buffer.width
-		for x := 0; x < front_buffer.width; {
-			cell_offset := line_offset + x
-			back := &back_buffer.cells[cell_offset]
-			front := &front_buffer.cells[cell_offset]
-			if back.Ch < ' ' {
-				back.Ch = ' '
-			}
-			w := runewidth.RuneWidth(back.Ch)
-			if w == 0 || w == 2 && runewidth.IsAmbiguousWidth(back.Ch) {
-				w = 1
-			}
-			if *back == *front {
-				x += w
-				continue
-			}
-			*front = *back
-			send_attr(back.Fg, back.Bg)
-
-			if w == 2 && x == front_buffer.width-1 {
-				// there's not enough space for 2-cells rune,
-				// let's just put a space in there
-				send_char(x, y, ' ')
-			} else {
-				send_char(x, y, back.Ch)
-				if w == 2 {
-					next := cell_offset + 1
-					front_buffer.cells[next] = Cell{
-						Ch: 0,
-						Fg: back.Fg,
-						Bg: back.Bg,
-					}
-				}
-			}
-			x += w
-		}
+	if !suspended {
+		return nil
 	}
-	if !is_cursor_hidden(cursor_x, cursor_y) {
-		write_cursor(cursor_x, cursor_y)
+	err := reenter_term()
+	if err != nil {
+		return err
 	}
-	return flush()
+	suspended = false
+
+	front_buffer.clear()
+	back_buffer.mark_dirty(0, back_buffer.height)
+	err = send_clear()
+	if err != nil {
+		return err
+	}
+	return present()
+}
+
+// Synchronizes the internal back buffer with the terminal. Returns the error
+// of writing to the terminal, if any, e.g. when the terminal went away.
+func Flush() error {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return present()
 }
 
 // Sets the position of the cursor. See also HideCursor().
 func SetCursor(x, y int) {
-	if is_cursor_hidden(cursor_x, cursor_y) && !is_cursor_hidden(x, y) {
-		outbuf.WriteString(funcs[t_show_cursor])
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	set_cursor(x, y)
+}
+
+// The shortcut for SetCursor(-1, -1).
+func HideCursor() {
+	SetCursor(cursor_hidden, cursor_hidden)
+}
+
+// Sets the shape of the cursor, the change is sent to the terminal by the next
+// Flush. Terminals which don't support cursor styles (DECSCUSR) ignore it.
+// CursorDefault restores the terminal's default cursor, Close does it as well.
+func SetCursorStyle(style CursorStyle) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if style < CursorDefault || style > CursorBarSteady {
+		return
 	}
+	cursor_style = style
+	write_cursor_style(style)
+}
 
-	if !is_cursor_hidden(cursor_x, cursor_y) && is_cursor_hidden(x, y) {
-		outbuf.WriteString(funcs[t_hide_cursor])
+// Sets the title of the terminal window, the change is sent to the terminal by
+// the next Flush. Control characters in the title are dropped. The previous
+// title is saved on the terminal's title stack and restored by Close, on
+// terminals which support it.
+func SetTitle(title string) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !title_pushed {
+		outbuf.WriteString(ti_push_title)
+		title_pushed = true
+	}
+	outbuf.WriteString("\033]0;")
+	for _, r := range title {
+		if r < ' ' || r >= 0x7f && r < 0xa0 {
+			continue
+		}
+		outbuf.WriteRune(r)
 	}
+	outbuf.WriteString("\007")
+}
+
+// Rings the terminal bell. Unlike other output functions it doesn't wait for
+// the next Flush, the output buffer is flushed right away.
+func Beep() error {
+	api_lock.Lock()
+	defer api_lock.Unlock()
 
-	cursor_x, cursor_y = x, y
-	if !is_cursor_hidden(cursor_x, cursor_y) {
-		write_cursor(cursor_x, cursor_y)
+	outbuf.WriteString("\007")
+	return flush()
+}
+
+// Flashes the screen instead of ringing the bell (terminfo's flash), e.g. for
+// users who have turned the sound off. Rings the bell if the terminal can't
+// flash. Like Beep, it doesn't wait for the next Flush, and it returns when the
+// flash is over, which may take a few hundred milliseconds.
+func VisualBell() error {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if funcs[t_flash] == "" {
+		outbuf.WriteString("\007")
+		return flush()
 	}
+	return send_padded(funcs[t_flash])
 }
 
-// The shortcut for SetCursor(-1, -1).
-func HideCursor() {
-	SetCursor(cursor_hidden, cursor_hidden)
+// Writes the output buffered by the functions which wait for the next Flush
+// (e.g. SetTitle or SetCursorStyle) to the terminal right away. Unlike Flush,
+// it doesn't draw the changes of the internal back buffer.
+func FlushOutput() error {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return flush()
 }
 
-// Changes cell's parameters in the internal back buffer at the specified
-// position.
-func SetCell(x, y int, ch rune, fg, bg Attribute) {
-	if x < 0 || x >= back_buffer.width {
-		return
+// Appends the bytes to the output buffer as they are, e.g. a control sequence
+// termbox doesn't support. They are sent to the terminal by the next Flush (or
+// FlushOutput) in order with the rest of the buffered output. Sequences which
+// move the cursor or change the screen confuse Flush, call Sync afterwards.
+func RawWrite(b []byte) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	outbuf.Write(b)
+}
+
+// Asks the terminal where its cursor is (DSR 6) and waits for the answer,
+// e.g. to find out where the shell prompt left the cursor. The output buffer is
+// flushed first. Returns an error if the terminal doesn't answer within a
+// second. The input which arrives in the meantime is kept for PollEvent. Like
+// PollEvent, it must not be called concurrently with the other event
+// functions.
+//
+// Note that the cursor is only where SetCursor put it after a Flush.
+func QueryCursorPosition() (x, y int, err error) {
+	api_lock.Lock()
+	if headless || suspended {
+		api_lock.Unlock()
+		return 0, 0, errors.New("termbox: no terminal to query")
+	}
+	outbuf.WriteString("\033[6n")
+	err = flush()
+	api_lock.Unlock()
+	if err != nil {
+		return 0, 0, err
 	}
-	if y < 0 || y >= back_buffer.height {
+	return read_cursor_position(time.Second)
+}
+
+// Puts the text into the system clipboard using the OSC 52 sequence, which
+// also works over SSH. The output buffer is flushed right away. Terminals
+// which don't support OSC 52, or have it disabled, ignore it.
+//
+// The whole text is sent as one sequence, OSC 52 can't be split into chunks.
+// Terminals limit the size of the sequence they accept (the base64 encoding
+// makes it a third larger than the text) and drop larger ones, often without
+// any notice, so large texts may not make it into the clipboard.
+func SetClipboard(text string) error {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	outbuf.WriteString("\033]52;c;")
+	enc := base64.NewEncoder(base64.StdEncoding, &outbuf)
+	enc.Write([]byte(text))
+	enc.Close()
+	outbuf.WriteString("\007")
+	return flush()
+}
+
+// Changes the color the terminal displays for the palette entry 'index' (OSC
+// 4), the change is sent to the terminal by the next Flush. Entries 0..7 are
+// the colors ColorBlack..ColorWhite are drawn with in OutputNormal mode, 8..15
+// their bright variants, up to 255 in Output256 mode. Close restores the
+// default palette, so does ResetPalette. Terminals which don't support
+// palette changes ignore it.
+func SetPaletteColor(index int, r, g, b uint8) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if index < 0 || index > 255 {
 		return
 	}
+	outbuf.WriteString("\033]4;")
+	outbuf.Write(strconv.AppendUint(intbuf, uint64(index), 10))
+	outbuf.WriteString(";")
+	write_osc_rgb(r, g, b)
+	outbuf.WriteString("\007")
+	palette_set = true
+}
+
+// Restores the terminal's default palette changed by SetPaletteColor.
+func ResetPalette() {
+	api_lock.Lock()
+	defer api_lock.Unlock()
 
-	back_buffer.cells[y*back_buffer.width+x] = Cell{ch, fg, bg}
+	outbuf.WriteString(ti_reset_palette)
+	palette_set = false
+}
+
+// Changes the terminal's default foreground and background colors (OSC 10 and
+// 11), which the cells with ColorDefault are drawn with. 'fg' and 'bg' are
+// colors created by RGBToAttribute, any other value restores the terminal's
+// original default color. The change is sent to the terminal by the next
+// Flush, Close restores the original colors. Terminals which don't support it
+// ignore it.
+func SetDefaultColors(fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if fg&attr_rgb != 0 {
+		outbuf.WriteString("\033]10;")
+		write_osc_rgb(AttributeToRGB(fg))
+		outbuf.WriteString("\007")
+		default_set = true
+	} else {
+		outbuf.WriteString(ti_reset_default_fg)
+	}
+	if bg&attr_rgb != 0 {
+		outbuf.WriteString("\033]11;")
+		write_osc_rgb(AttributeToRGB(bg))
+		outbuf.WriteString("\007")
+		default_set = true
+	} else {
+		outbuf.WriteString(ti_reset_default_bg)
+	}
+}
+
+// Sets how long PollEvent waits for the rest of an escape sequence after
+// reading a lone ESC byte, before reporting it as KeyEsc (or ModAlt in Alt
+// input mode). Longer delays help with slow connections where sequences arrive
+// in pieces, zero disables waiting. The default is 100ms on macOS and zero
+// elsewhere, Close restores it.
+func SetEscDelay(d time.Duration) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if d < 0 {
+		d = 0
+	}
+	esc_delay = d
 }
 
 // Returns a slice into the termbox's back buffer. You can get its dimensions
 // using 'Size' function. The slice remains valid as long as no 'Clear' or
-// 'Flush' function calls were made after call to this function.
+// 'Flush' function calls were made after call to this function. These resize
+// the back buffer when the terminal size has changed, so fetch the slice and
+// the size again after each of them, EventResize in particular means the old
+// slice is stale. Cells modified directly through the slice keep their
+// combining characters, see SetCellWithCombining. Once the slice was taken,
+// Flush compares the whole buffer instead of only the rows changed through
+// SetCell and friends.
 func CellBuffer() []Cell {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	cells_exposed = true
 	return back_buffer.cells
 }
 
@@ -306,98 +485,74 @@ func PollRawEvent(data []byte) Event {
 			return event
 
 		case <-sigwinch:
+			wait_resize_settle()
 			event.Type = EventResize
-			event.Width, event.Height = get_term_size(out.Fd())
+			event.Width, event.Height = report_resize()
 			return event
 		}
 	}
 }
 
-// Wait for an event and return it. This is a blocking function call.
+// Wait for an event and return it. This is a blocking function call. If
+// reading the input fails (io.EOF when the terminal is closed), EventError is
+// returned once and no further input events are delivered.
 func PollEvent() Event {
-	// Constant governing macOS specific behavior. See https://github.com/nsf/termbox-go/issues/132
-	// This is an arbitrary delay which hopefully will be enough time for any lagging
-	// partial escape sequences to come through.
-	const esc_wait_delay = 100 * time.Millisecond
-
-	var event Event
-	var esc_wait_timer *time.Timer
-	var esc_timeout <-chan time.Time
-
-	// try to extract event from input buffer, return on success
-	event.Type = EventKey
-	status := extract_event(inbuf, &event, true)
-	if event.N != 0 {
-		copy(inbuf, inbuf[event.N:])
-		inbuf = inbuf[:len(inbuf)-event.N]
-	}
-	if status == event_extracted {
-		return event
-	} else if status == esc_wait {
-		esc_wait_timer = time.NewTimer(esc_wait_delay)
-		esc_timeout = esc_wait_timer.C
-	}
-
-	for {
-		select {
-		case ev := <-input_comm:
-			if esc_wait_timer != nil {
-				if !esc_wait_timer.Stop() {
-					<-esc_wait_timer.C
-				}
-				esc_wait_timer = nil
-			}
-
-			if ev.err != nil {
-				return Event{Type: EventError, Err: ev.err}
-			}
-
-			inbuf = append(inbuf, ev.data...)
-			input_comm <- ev
-			status := extract_event(inbuf, &event, true)
-			if event.N != 0 {
-				copy(inbuf, inbuf[event.N:])
-				inbuf = inbuf[:len(inbuf)-event.N]
-			}
-			if status == event_extracted {
-				return event
-			} else if status == esc_wait {
-				esc_wait_timer = time.NewTimer(esc_wait_delay)
-				esc_timeout = esc_wait_timer.C
-			}
-		case <-esc_timeout:
-			esc_wait_timer = nil
-
-			status := extract_event(inbuf, &event, false)
-			if event.N != 0 {
-				copy(inbuf, inbuf[event.N:])
-				inbuf = inbuf[:len(inbuf)-event.N]
-			}
-			if status == event_extracted {
-				return event
-			}
-		case <-interrupt_comm:
-			event.Type = EventInterrupt
-			return event
-
-		case <-sigwinch:
-			event.Type = EventResize
-			event.Width, event.Height = get_term_size(out.Fd())
-			return event
-		}
-	}
+	event, _ := poll_event(nil)
+	return event
 }
 
 // Returns the size of the internal back buffer (which is mostly the same as
 // terminal's window size in characters). But it doesn't always match the size
 // of the terminal window, after the terminal size has changed, the internal
-// back buffer will get in sync only after Clear or Flush function calls.
+// back buffer will get in sync only after Clear or Flush function calls. Once
+// an EventResize has been returned by PollEvent, Clear and Flush resize the
+// buffer to the size reported by the latest EventResize. SetSize overrides the
+// size of the terminal and resizes the buffer right away.
 func Size() (width int, height int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
 	return termw, termh
 }
 
+// Writes the contents of the internal back buffer to 'w' as text with the
+// escape sequences for the colors and attributes, one line per row, e.g. to
+// save a snapshot of the screen to a file, which can be shown later using
+// 'cat'. The colors are written according to the current output mode. Nothing
+// is sent to the terminal.
+func RenderTo(w io.Writer) error {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !IsInit {
+		return errors.New("termbox: not initialized")
+	}
+	return render_to(w)
+}
+
+// Sets the size of the buffers, overriding the size of the terminal, e.g. when
+// SIGWINCH is not handled (see InitOptions) and the size is known from
+// elsewhere. The buffers are resized right away, the cells which fit into the
+// new size are kept, and the next Flush redraws the whole screen. The size
+// stays until the next SetSize or EventResize. Non-positive sizes are
+// ignored.
+func SetSize(w, h int) {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if w <= 0 || h <= 0 {
+		return
+	}
+	set_reported_size(w, h)
+	update_size_maybe()
+}
+
 // Clears the internal back buffer.
 func Clear(fg, bg Attribute) error {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
 	foreground, background = fg, bg
 	err := update_size_maybe()
 	back_buffer.clear()
@@ -411,39 +566,82 @@ func Clear(fg, bg Attribute) error {
 //
 // 2. Alt input mode. When ESC sequence is in the buffer and it doesn't match
 // any known sequence. ESC enables ModAlt modifier for the next keyboard event.
+// Bytes which are not valid UTF-8 are taken for keys sent with the 8th bit set
+// by the terminal's meta key, they are reported with ModAlt as well. So is the
+// start of a UTF-8 sequence (e.g. Alt+a is 0xE1) if the rest of the sequence
+// doesn't follow within the escape delay.
 //
 // Both input modes can be OR'ed with Mouse mode. Setting Mouse mode bit up will
-// enable mouse button press/release and drag events.
+// enable mouse button press/release and drag events. Drag events have the
+// ModMotion modifier set.
+//
+// Mouse mode can be further OR'ed with MouseMotion mode, which enables
+// reporting of the mouse movement when no button is pressed. These events are
+// reported as MouseRelease with the ModMotion modifier set. MouseMotion mode
+// has no effect without Mouse mode.
+//
+// Paste mode can be OR'ed as well, it enables bracketed paste. Text pasted
+// into the terminal is then reported as a single EventPaste event instead of a
+// series of key events. Terminals which don't support bracketed paste keep
+// reporting pasted text as key events.
+//
+// Focus mode can be OR'ed too, it enables focus reporting: an EventFocus event
+// is reported when the terminal window gains or loses focus. Terminals which
+// don't support it report nothing.
+//
+// Coalesce mode merges identical key events which are ready at the same time,
+// e.g. when a key is held down and the application can't keep up, into one
+// event with the 'Repeat' field set to their number. Without it every key
+// press is a separate event and 'Repeat' is 0.
 //
 // If 'mode' is InputCurrent, returns the current input mode. See also Input*
 // constants.
 func SetInputMode(mode InputMode) InputMode {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
 	if mode == InputCurrent {
 		return input_mode
 	}
-	if mode&(InputEsc|InputAlt) == 0 {
-		mode |= InputEsc
-	}
-	if mode&(InputEsc|InputAlt) == InputEsc|InputAlt {
-		mode &^= InputAlt
+	set_input_mode(mode)
+	flush()
+	return input_mode
+}
+
+// Switches the keypad between the application mode (true), which termbox
+// enables by Init, and the numeric mode (false). In the numeric mode the
+// numeric keypad produces plain digits and operators, in the application mode
+// the terminal sends escape sequences for them, which are reported as the
+// same runes (and KeyEnter for the keypad's Enter) anyway. Some terminals
+// send the cursor keys differently in each mode, both forms are recognized.
+func SetKeypadMode(application bool) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if suspended {
+		// reenter_term enables the mode on Resume
+		keypad_app = application
+		return
 	}
-	if mode&InputMouse != 0 {
-		out.WriteString(funcs[t_enter_mouse])
+	if application {
+		outbuf.WriteString(funcs[t_enter_keypad])
 	} else {
-		out.WriteString(funcs[t_exit_mouse])
+		outbuf.WriteString(funcs[t_exit_keypad])
 	}
-
-	input_mode = mode
-	return input_mode
+	flush()
+	keypad_app = application
 }
 
-// Sets the termbox output mode. Termbox has four output options:
+// Sets the termbox output mode. Termbox has five output options:
 //
-// 1. OutputNormal => [1..8]
-//    This mode provides 8 different colors:
+// 1. OutputNormal => [1..16]
+//    This mode provides 8 different colors and their bright variants:
 //        black, red, green, yellow, blue, magenta, cyan, white
-//    Shortcut: ColorBlack, ColorRed, ...
-//    Attributes: AttrBold, AttrUnderline, AttrReverse
+//    Shortcut: ColorBlack, ColorRed, ..., ColorDarkGray, ColorLightRed, ...
+//    On the linux console AttrBold is drawn as the bright variant of the
+//    color, termbox asks for the bright color directly there.
+//    Attributes: AttrBold, AttrUnderline, AttrReverse, AttrBlink, AttrDim,
+//    AttrItalic, AttrStrikethrough, AttrDoubleUnderline, AttrCurlyUnderline
 //
 //    Example usage:
 //        SetCell(x, y, '@', ColorBlack | AttrBold, ColorRed);
@@ -461,12 +659,21 @@ func SetInputMode(mode InputMode) InputMode {
 //
 // 3. Output216 => [1..216]
 //    This mode supports the 3rd range of the 256 mode only.
-//    But you don't need to provide an offset.
+//    But you don't need to provide an offset. Larger values are clamped
+//    to 216.
 //
 // 4. OutputGrayscale => [1..26]
 //    This mode supports the 4th range of the 256 mode
 //    and black and white colors from 3th range of the 256 mode
-//    But you don't need to provide an offset.
+//    But you don't need to provide an offset. Larger values are clamped
+//    to 26.
+//
+// 5. OutputRGB => [1..256] + RGB
+//    This mode supports the same colors as Output256 mode and in addition
+//    24-bit colors created using RGBToAttribute function.
+//
+//    Example usage:
+//        SetCell(x, y, '@', RGBToAttribute(255, 128, 0), 240);
 //
 // In all modes, 0x00 represents the default color.
 //
@@ -477,6 +684,9 @@ func SetInputMode(mode InputMode) InputMode {
 // Note that this may return a different OutputMode than the one requested,
 // as the requested mode may not be available on the target platform.
 func SetOutputMode(mode OutputMode) OutputMode {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
 	if mode == OutputCurrent {
 		return output_mode
 	}
@@ -490,11 +700,19 @@ func SetOutputMode(mode OutputMode) OutputMode {
 // forces a complete resync between the termbox and a terminal, it may not be
 // visually pretty though.
 func Sync() error {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if suspended {
+		return nil
+	}
 	front_buffer.clear()
+	back_buffer.mark_dirty(0, back_buffer.height)
 	err := send_clear()
 	if err != nil {
 		return err
 	}
 
-	return Flush()
+	return present()
 }
@@ -3,18 +3,31 @@ package termbox
 
 // public API, common OS agnostic part
 
+import (
+	"context"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+)
+
 type (
-	InputMode  int
-	OutputMode int
-	EventType  uint8
-	Modifier   uint8
-	Key        uint16
-	Attribute  uint16
+	InputMode   int
+	OutputMode  int
+	EventType   uint8
+	Modifier    uint8
+	Key         uint16
+	Attribute   uint64
+	CursorStyle int
 )
 
 // This type represents a termbox event. The 'Mod', 'Key' and 'Ch' fields are
 // valid if 'Type' is EventKey. The 'Width' and 'Height' fields are valid if
 // 'Type' is EventResize. The 'Err' field is valid if 'Type' is EventError.
+// The 'Mod', 'Key', 'MouseX' and 'MouseY' fields are valid if 'Type' is
+// EventMouse, in that case 'Key' is one of Mouse* constants. The 'Paste' field
+// is valid if 'Type' is EventPaste. The 'Focus' field is valid if 'Type' is
+// EventFocus. PollEvent reports escape sequences it doesn't recognize as
+// EventRaw events with the sequence in the 'Raw' field.
 type Event struct {
 	Type   EventType // one of Event* constants
 	Mod    Modifier  // one of Mod* constants or 0
@@ -26,6 +39,10 @@ type Event struct {
 	MouseX int       // x coord of mouse
 	MouseY int       // y coord of mouse
 	N      int       // number of bytes written when getting a raw event
+	Paste  string    // pasted text, see InputPaste
+	Focus  bool      // true if the window gained focus, see InputFocus
+	Raw    []byte    // unrecognized escape sequence
+	Repeat int       // number of identical key presses, see InputCoalesce
 }
 
 // A cell, single conceptual entity on the screen. The screen is basically a 2d
@@ -37,12 +54,62 @@ type Cell struct {
 	Bg Attribute
 }
 
-// To know if termbox has been initialized or not
+// Returns true if the cells look the same on the screen. Flush uses it to find
+// the cells which have changed, use it instead of '==' to compare cells, so
+// the code keeps working if Cell gets fields which are not comparable.
+func CellsEqual(a, b Cell) bool {
+	return a.Ch == b.Ch && a.Fg == b.Fg && a.Bg == b.Bg
+}
+
+// Settings of the terminal which are applied at the initialization, before
+// anything is drawn, see InitWithOptions. The zero value gives the behavior of
+// Init.
+type InitOptions struct {
+	// Don't switch to the alternate screen, so that the contents of the
+	// screen stay visible in the terminal after Close, like the output of
+	// a pager which is run without clearing the screen.
+	NoAltScreen bool
+
+	// Don't handle SIGWINCH, e.g. when the program handles it itself or
+	// the terminal is remote and the size arrives some other way. There
+	// are no EventResize events then, the size is polled by Clear and
+	// Flush or set using SetSize. SIGIO is still used to read the input.
+	// The terminal may have no size yet (e.g. a pseudo-terminal which
+	// wasn't given one), the buffers are empty until SetSize then.
+	NoSignals bool
+
+	// The input mode to start in, see SetInputMode. InputCurrent keeps
+	// the default one, InputEsc.
+	InputMode InputMode
+
+	// The output mode to start in, see SetOutputMode. OutputCurrent keeps
+	// the one chosen according to the terminal's capabilities.
+	OutputMode OutputMode
+
+	// How long to wait for the rest of an escape sequence, see
+	// SetEscDelay. Zero keeps the default delay, a negative value disables
+	// waiting.
+	EscDelay time.Duration
+}
+
+// Features of the terminal detected by Init, see Capabilities.
+type TerminalCapabilities struct {
+	Colors    int  // number of colors, 0 for monochrome terminals
+	TrueColor bool // RGB colors (OutputRGB) are supported
+	Mouse     bool // mouse reporting (InputMouse) is supported
+	Undercurl bool // double and curly underlines are supported
+}
+
+// To know if termbox has been initialized or not. It's set by the Init
+// functions and reset by Close.
 var (
 	IsInit bool = false
 )
 
-// Key constants, see Event.Key field.
+// Key constants, see Event.Key field. Mouse* constants are reported as
+// Event.Key of EventMouse events, see SetInputMode function. Some terminals
+// (e.g. xterm) send Shift+F1..F12 as F13..F24, these are reported as
+// KeyF13..KeyF24 then.
 const (
 	KeyF1 Key = 0xFFFF - iota
 	KeyF2
@@ -66,13 +133,27 @@ const (
 	KeyArrowDown
 	KeyArrowLeft
 	KeyArrowRight
-	key_min // see terminfo
+	key_min // see key_at
 	MouseLeft
 	MouseMiddle
 	MouseRight
 	MouseRelease
 	MouseWheelUp
 	MouseWheelDown
+
+	// added later, after the mouse constants to keep their values
+	KeyF13
+	KeyF14
+	KeyF15
+	KeyF16
+	KeyF17
+	KeyF18
+	KeyF19
+	KeyF20
+	KeyF21
+	KeyF22
+	KeyF23
+	KeyF24
 )
 
 const (
@@ -124,14 +205,22 @@ const (
 	KeyCtrl8          Key = 0x7F
 )
 
-// Alt modifier constant, see Event.Mod field and SetInputMode function.
+// Modifier constants, see Event.Mod field and SetInputMode function. ModCtrl
+// and ModShift are reported for keys which don't have a Ctrl or Shift variant
+// among Key* constants, e.g. Ctrl+Right is KeyArrowRight with ModCtrl set.
 const (
 	ModAlt Modifier = 1 << iota
 	ModMotion
+	ModCtrl
+	ModShift
 )
 
 // Cell colors, you can combine a color with multiple attributes using bitwise
-// OR ('|').
+// OR ('|'). These constants are valid in all output modes except Output216 and
+// OutputGrayscale, in Output256 mode they map to the first 16 colors of the
+// 256 colors palette. ColorDarkGray..ColorLightGray are the bright variants of
+// ColorBlack..ColorWhite. In OutputRGB mode colors can also be created using
+// RGBToAttribute function. See SetOutputMode function.
 const (
 	ColorDefault Attribute = iota
 	ColorBlack
@@ -142,20 +231,41 @@ const (
 	ColorMagenta
 	ColorCyan
 	ColorWhite
+	ColorDarkGray
+	ColorLightRed
+	ColorLightGreen
+	ColorLightYellow
+	ColorLightBlue
+	ColorLightMagenta
+	ColorLightCyan
+	ColorLightGray
 )
 
 // Cell attributes, it is possible to use multiple attributes by combining them
 // using bitwise OR ('|'). Although, colors cannot be combined. But you can
-// combine attributes and a single color.
+// combine attributes and a single color. The attributes occupy the upper 32
+// bits of an Attribute, the lower ones are left to the colors, which need 25
+// bits for RGBToAttribute values. Don't store attributes in narrower types or
+// depend on the numeric values of the constants.
 //
 // It's worth mentioning that some platforms don't support certain attributes.
-// For example windows console doesn't support AttrUnderline. And on some
-// terminals applying AttrBold to background may result in blinking text. Use
-// them with caution and test your code on various terminals.
+// For example windows console doesn't support AttrUnderline, AttrBlink,
+// AttrDim, AttrItalic and AttrStrikethrough. And on some terminals applying
+// AttrBold to background may result in blinking text. AttrDoubleUnderline and
+// AttrCurlyUnderline are drawn as AttrUnderline on terminals which don't
+// support them, see TerminalCapabilities. Terminals which don't support an
+// attribute simply ignore it. Use them with caution and test your code on
+// various terminals.
 const (
-	AttrBold Attribute = 1 << (iota + 9)
+	AttrBold Attribute = 1 << (iota + 32)
 	AttrUnderline
 	AttrReverse
+	AttrBlink
+	AttrDim
+	AttrItalic
+	AttrStrikethrough
+	AttrDoubleUnderline
+	AttrCurlyUnderline
 )
 
 // Input mode. See SetInputMode function.
@@ -163,6 +273,10 @@ const (
 	InputEsc InputMode = 1 << iota
 	InputAlt
 	InputMouse
+	InputMouseMotion
+	InputPaste
+	InputFocus
+	InputCoalesce
 	InputCurrent InputMode = 0
 )
 
@@ -173,6 +287,7 @@ const (
 	Output256
 	Output216
 	OutputGrayscale
+	OutputRGB
 )
 
 // Event type. See Event.Type field.
@@ -184,4 +299,468 @@ const (
 	EventInterrupt
 	EventRaw
 	EventNone
+	EventPaste
+	EventFocus
 )
+
+// Cursor style. See SetCursorStyle function.
+const (
+	CursorDefault CursorStyle = iota
+	CursorBlockBlink
+	CursorBlockSteady
+	CursorUnderlineBlink
+	CursorUnderlineSteady
+	CursorBarBlink
+	CursorBarSteady
+)
+
+// Changes cell's parameters in the internal back buffer at the specified
+// position.
+//
+// SetCell and the other functions working with the buffers or the output are
+// safe for concurrent use, e.g. worker goroutines may update cells while
+// another goroutine calls Flush. The slice returned by CellBuffer is not
+// protected though.
+func SetCell(x, y int, ch rune, fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	set_cell(x, y, ch, fg, bg)
+}
+
+// Same as SetCell, but takes the cell's parameters as a Cell value.
+func PutCell(x, y int, cell Cell) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	set_cell(x, y, cell.Ch, cell.Fg, cell.Bg)
+}
+
+// Returns true if the cursor is shown, i.e. it was placed using SetCursor and
+// not hidden since then.
+func IsCursorVisible() bool {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return !is_cursor_hidden(cursor_x, cursor_y)
+}
+
+// Returns the position of the cursor as set by SetCursor, or -1, -1 if the
+// cursor is hidden.
+func CursorPosition() (int, int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if is_cursor_hidden(cursor_x, cursor_y) {
+		return cursor_hidden, cursor_hidden
+	}
+	return cursor_x, cursor_y
+}
+
+// Returns the attributes passed to the last Clear call. They are also used to
+// fill the new parts of the screen when the terminal is resized, so a
+// component which clears with its own attributes can restore them afterwards.
+func ClearAttributes() (fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return foreground, background
+}
+
+// A replacement for deferred Close which also restores the terminal if the
+// program panics, so that the panic message is readable and the shell usable
+// afterwards:
+//
+//	err := termbox.Init()
+//	if err != nil {
+//		panic(err)
+//	}
+//	defer termbox.RecoverAndClose()
+//
+// It calls Close and, if there was a panic, re-panics with the same value.
+// Only panics of the goroutine which deferred it are caught.
+func RecoverAndClose() {
+	r := recover()
+	Close()
+	if r != nil {
+		panic(r)
+	}
+}
+
+// Makes termbox restore the terminal when the process is asked to terminate by
+// SIGTERM, SIGHUP or SIGINT (e.g. by systemd or when the terminal window is
+// closed): Close is called and the process exits with the status 128 + the
+// signal number. Note that Ctrl-C doesn't generate SIGINT while termbox is
+// initialized, it's reported as KeyCtrlC instead. The handler is removed by
+// Close.
+func CloseOnSignal() {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	start_close_signals()
+}
+
+// Returns the features of the terminal detected by Init. The number of colors
+// and mouse support come from terminfo (or the builtin terminal descriptions,
+// guessed from TERM), true color support from the COLORTERM environment
+// variable being "truecolor" or "24bit". Styled underlines are only assumed
+// on the terminals known to support them.
+func Capabilities() TerminalCapabilities {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return caps
+}
+
+// Returns the number of colors the terminal supports according to terminfo
+// (or the builtin terminal descriptions), e.g. 8 for "screen" and 256 for
+// "xterm-256color". It's the same as Capabilities().Colors, true color support
+// is reported separately by Capabilities.
+func ColorCount() int {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return caps.Colors
+}
+
+// Returns a color attribute for the given RGB triplet. Such colors are only
+// supported in OutputRGB mode, in all other modes they are rendered using the
+// default color. The result can be combined with other attributes.
+func RGBToAttribute(r, g, b uint8) Attribute {
+	return attr_rgb | Attribute(r)<<16 | Attribute(g)<<8 | Attribute(b)
+}
+
+// Returns the RGB triplet of a color attribute created by RGBToAttribute. For
+// other colors it returns zeros.
+func AttributeToRGB(a Attribute) (r, g, b uint8) {
+	if a&attr_rgb == 0 {
+		return 0, 0, 0
+	}
+	return uint8(a >> 16), uint8(a >> 8), uint8(a)
+}
+
+// Wait for an event and return it. This is a blocking function call, just
+// like PollEvent, but it returns early with the context's error when 'ctx' is
+// cancelled. In that case the returned event is EventNone and the input which
+// was read so far is kept for the next call.
+func PollEventContext(ctx context.Context) (Event, error) {
+	event, ok := poll_event(ctx.Done())
+	if !ok {
+		return event, ctx.Err()
+	}
+	return event, nil
+}
+
+// Wait for an event and return it, but no longer than 'd'. Returns false if no
+// event arrived in time, the input which was read so far is kept for the next
+// call then.
+func PollEventTimeout(d time.Duration) (Event, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	event, err := PollEventContext(ctx)
+	return event, err == nil
+}
+
+// Returns the event PollEvent would return next without removing it, if the
+// event is ready already: the input which was read from the terminal but not
+// returned yet (e.g. the rest of a burst of key presses), or an injected
+// event. Returns false if there's no such event, PollEvent would wait then.
+// Like PollEvent, it must not be called concurrently with the other event
+// functions.
+func PeekEvent() (Event, bool) {
+	return peek_event()
+}
+
+// Returns a channel which delivers events, an alternative to calling
+// PollEvent in a loop. The first call starts a goroutine which polls events
+// and sends them to the channel, subsequent calls return the same channel.
+// The channel is closed by Close, so ranging over it terminates.
+//
+// Don't use PollEvent and friends while the channel is in use, the events
+// would be split between them.
+func Events() <-chan Event {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if events_comm == nil {
+		events_comm = make(chan Event)
+		events_quit = make(chan struct{})
+		events_done = make(chan struct{})
+		go events_producer(events_comm, events_quit, events_done)
+	}
+	return events_comm
+}
+
+// Returns the number of terminal columns the rune occupies: 0 for combining
+// marks and other zero-width runes, 2 for wide (East Asian) runes and 1
+// otherwise. Ambiguous width runes are considered narrow, that's how Flush
+// draws them.
+func RuneWidth(r rune) int {
+	w := runewidth.RuneWidth(r)
+	if w == 2 && runewidth.IsAmbiguousWidth(r) {
+		return 1
+	}
+	return w
+}
+
+// Returns the number of terminal columns the string occupies, see RuneWidth.
+func StringWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += RuneWidth(r)
+	}
+	return w
+}
+
+// Changes cell's parameters in the internal back buffer at the specified
+// position, like SetCell, and attaches combining characters (e.g. accents or
+// emoji modifiers) to it. They are drawn after the base rune 'ch' in the same
+// cell. SetCell, Fill, Blit and Clear remove the combining characters of the
+// cells they change.
+//
+// Combining characters are not supported on windows, they are ignored there.
+func SetCellWithCombining(x, y int, ch rune, comb []rune, fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	set_cell(x, y, ch, fg, bg)
+	if x < 0 || x >= back_buffer.width {
+		return
+	}
+	if y < 0 || y >= back_buffer.height {
+		return
+	}
+	if len(comb) != 0 {
+		// set_cell has marked the row dirty
+		i := y*back_buffer.width + x
+		back_buffer.extras[i].comb = append([]rune(nil), comb...)
+	}
+}
+
+// Fills the rectangle of the internal back buffer with the top-left corner at
+// 'x', 'y' and the size 'w', 'h' with the given cell. Parts of the rectangle
+// which lie outside of the buffer are clipped.
+func Fill(x, y, w, h int, cell Cell) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.fill(Rect{x, y, w, h}, cell)
+}
+
+// Clears the rectangle of the internal back buffer with the top-left corner at
+// 'x', 'y' and the size 'w', 'h' the same way Clear clears the whole buffer:
+// with spaces in the attributes given to the last Clear call (see
+// ClearAttributes). Parts of the rectangle which lie outside of the buffer are
+// clipped.
+func ClearRegion(x, y, w, h int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.fill(Rect{x, y, w, h}, Cell{' ', foreground, background})
+}
+
+// Copies the cells into the internal back buffer. 'cells' is a rectangle
+// 'w' cells wide, its top-left corner is placed at 'x', 'y'. Only the part
+// which is inside of the buffer is copied, 'x' and 'y' may be negative.
+// Returns the number of cells written.
+func Blit(x, y, w int, cells []Cell) int {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	return back_buffer.blit(x, y, w, cells, false)
+}
+
+// Same as Blit, but the cells with zero 'Ch' are transparent: they are skipped
+// and the cells of the internal back buffer under them stay as they are. This
+// allows to draw non-rectangular shapes. Returns the number of cells written,
+// transparent cells are not counted.
+func BlitTransparent(x, y, w int, cells []Cell) int {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	return back_buffer.blit(x, y, w, cells, true)
+}
+
+// Scrolls the contents of the rectangle of the internal back buffer with the
+// top-left corner at 'x', 'y' and the size 'w', 'h' by 'lines' rows. Positive
+// 'lines' scroll up (the rows move towards 'y', like a log), negative ones
+// scroll down. The rows exposed by scrolling are filled with the given cell.
+// Parts of the rectangle which lie outside of the buffer are clipped.
+func ScrollRegion(x, y, w, h, lines int, fill Cell) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	r := Rect{x, y, w, h}.Intersect(back_buffer.bounds())
+	if r.Empty() || lines == 0 {
+		return
+	}
+
+	switch {
+	case lines >= r.H || -lines >= r.H:
+		back_buffer.fill(r, fill)
+	case lines > 0:
+		back_buffer.copy_region(r.X, r.Y+lines, r.W, r.H-lines, r.X, r.Y)
+		back_buffer.fill(Rect{r.X, r.Y + r.H - lines, r.W, lines}, fill)
+	default:
+		back_buffer.copy_region(r.X, r.Y, r.W, r.H+lines, r.X, r.Y-lines)
+		back_buffer.fill(Rect{r.X, r.Y, r.W, -lines}, fill)
+	}
+}
+
+// Copies the rectangle of the internal back buffer with the top-left corner at
+// 'srcX', 'srcY' and the size 'w', 'h' to 'dstX', 'dstY'. The source and the
+// destination may overlap, the result is as if the rectangle was copied to a
+// temporary place first. Parts which lie outside of the buffer are clipped.
+func CopyRegion(srcX, srcY, w, h, dstX, dstY int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.copy_region(srcX, srcY, w, h, dstX, dstY)
+}
+
+// Returns the number of cells the last Flush (or Sync) found changed and sent
+// to the terminal. Useful for measuring how much of the screen an application
+// actually redraws.
+func ChangedCells() int {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return changed_cells
+}
+
+// Returns true if Flush has something to send to the terminal: cells of the
+// internal back buffer were changed since the last Flush, or there's buffered
+// output, e.g. from SetCursor. A render loop can skip the Flush of an
+// identical frame otherwise. Once CellBuffer was called it always returns
+// true, the changes made through the slice can't be tracked.
+func Dirty() bool {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if pending_output() {
+		return true
+	}
+	for y := 0; y < back_buffer.height; y++ {
+		if back_buffer.is_dirty(y) {
+			return true
+		}
+	}
+	return false
+}
+
+// When enabled, Flush sends all of the cells to the terminal instead of only
+// the ones which changed since the previous Flush. Meant for benchmarking and
+// debugging, it's disabled by default.
+func SetFullRedraw(enabled bool) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	full_redraw = enabled
+}
+
+// Returns the cell of the internal back buffer at the specified position.
+// Returns false if the position is outside of the buffer.
+func GetCell(x, y int) (Cell, bool) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if x < 0 || x >= back_buffer.width {
+		return Cell{}, false
+	}
+	if y < 0 || y >= back_buffer.height {
+		return Cell{}, false
+	}
+
+	return back_buffer.cells[y*back_buffer.width+x], true
+}
+
+// Turns 'length' cells of the internal back buffer starting at 'x', 'y' into
+// a hyperlink to 'url' (OSC 8), terminals which support it make them
+// clickable. An empty 'url' removes the link. The link stays when the cells
+// are changed using SetCell, Clear removes it.
+//
+// Hyperlinks are not supported on windows, they are ignored there.
+func SetLink(x, y, length int, url string) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if y < 0 || y >= back_buffer.height {
+		return
+	}
+	x0, x1 := max_int(x, 0), min_int(x+length, back_buffer.width)
+	back_buffer.dirty[y] = true
+	line_offset := y * back_buffer.width
+	for cx := x0; cx < x1; cx++ {
+		back_buffer.extras[line_offset+cx].link = url
+	}
+}
+
+// Sets the color the underlines of 'length' cells of the internal back buffer
+// starting at 'x', 'y' are drawn with (SGR 58), independently of the text
+// color. The color is given the same way as for the text, ColorDefault draws
+// the underlines with the text color. Like hyperlinks, the color stays when
+// the cells are changed using SetCell, Clear removes it. Terminals which don't
+// support underline colors ignore it.
+//
+// Underline colors are not supported on windows, they are ignored there.
+func SetUnderlineColor(x, y, length int, color Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if y < 0 || y >= back_buffer.height {
+		return
+	}
+	x0, x1 := max_int(x, 0), min_int(x+length, back_buffer.width)
+	back_buffer.dirty[y] = true
+	line_offset := y * back_buffer.width
+	for cx := x0; cx < x1; cx++ {
+		back_buffer.extras[line_offset+cx].ulcolor = color
+	}
+}
+
+// Registers a function to be called when termbox resizes its buffers to the
+// new size of the terminal, with the new width and height. That happens in
+// Flush, Sync, Clear and Resume, the callback is called right before they
+// return, from the same goroutine, so it may use the API (e.g. to redraw) and
+// doesn't depend on EventResize being polled. The callbacks stay registered
+// after Close.
+func OnResize(f func(w, h int)) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	resize_funcs = append(resize_funcs, f)
+}
+
+// Queues the event to be returned by PollEvent (and Events channel) ahead of
+// the terminal input. Safe to call from any goroutine. Mostly useful for
+// testing, see InitMock, but also to post application defined events.
+func InjectEvent(ev Event) {
+	push_injected(ev)
+}
+
+// Returns the contents of the internal back buffer as text, one line per row
+// separated by newlines. Only the runes are included (with their combining
+// characters), attributes are ignored. Useful for debugging and snapshot
+// tests.
+func DumpBuffer() string {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	var buf []rune
+	for y := 0; y < back_buffer.height; y++ {
+		if y != 0 {
+			buf = append(buf, '\n')
+		}
+		line_offset := y * back_buffer.width
+		for x := 0; x < back_buffer.width; {
+			ch := back_buffer.cells[line_offset+x].Ch
+			if ch < ' ' {
+				ch = ' '
+			}
+			w := RuneWidth(ch)
+			if w == 0 {
+				w = 1
+			}
+			if w == 2 && x == back_buffer.width-1 {
+				// doesn't fit, that's how Flush draws it
+				ch = ' '
+			}
+			buf = append(buf, ch)
+			buf = append(buf, back_buffer.extras[line_offset+x].comb...)
+			x += w
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,431 @@
+// +build !windows
+
+package termbox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Initializes termbox in headless mode writing to the returned buffer, the
+// library is closed when the test ends.
+func init_test_writer(t *testing.T, w, h int) *bytes.Buffer {
+	t.Helper()
+	out := new(bytes.Buffer)
+	if err := InitWithWriter(out, w, h); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+	return out
+}
+
+// Returns what RenderTo writes for the current back buffer.
+func render_string(t *testing.T) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := RenderTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// Returns the runes of the internal back buffer, one string per row.
+func buffer_rows() []string {
+	w, h := Size()
+	rows := make([]string, h)
+	for y := range rows {
+		row := make([]rune, w)
+		for x := range row {
+			c, _ := GetCell(x, y)
+			row[x] = c.Ch
+		}
+		rows[y] = string(row)
+	}
+	return rows
+}
+
+// Sets the rows of the internal back buffer to the given strings.
+func set_rows(rows ...string) {
+	for y, row := range rows {
+		for x, r := range []rune(row) {
+			SetCell(x, y, r, ColorDefault, ColorDefault)
+		}
+	}
+}
+
+func check_rows(t *testing.T, what string, want ...string) {
+	t.Helper()
+	got := buffer_rows()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("%s: the buffer is %q, want %q", what, got, want)
+	}
+}
+
+func TestOutputModeClampsColors(t *testing.T) {
+	init_test_writer(t, 1, 1)
+	for _, tt := range []struct {
+		mode    OutputMode
+		max     Attribute
+		invalid Attribute
+	}{
+		{Output216, 216, 1000},
+		{OutputGrayscale, 26, 1000},
+	} {
+		SetOutputMode(tt.mode)
+		SetCell(0, 0, 'x', tt.max, tt.max)
+		want := render_string(t)
+		SetCell(0, 0, 'x', tt.invalid, tt.invalid)
+		if got := render_string(t); got != want {
+			t.Errorf("mode %d: color %d rendered as %q, want %q (color %d)",
+				tt.mode, tt.invalid, got, want, tt.max)
+		}
+	}
+}
+
+func TestSetCursor(t *testing.T) {
+	out := init_test_writer(t, 10, 5)
+	out.Reset()
+	SetCursor(5, 2)
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("\033[3;6H")) {
+		t.Errorf("SetCursor(5, 2) sent %q, want it to contain %q", out.String(), "\033[3;6H")
+	}
+}
+
+func TestSplitRune(t *testing.T) {
+	euro := []byte("€")
+	first, second := euro[:2], euro[2:]
+
+	var event Event
+	if status := extract_event(first, &event, true); status != esc_wait || event.N != 0 {
+		t.Fatalf("first chunk: got status %d with N %d, want esc_wait with N 0", status, event.N)
+	}
+	if ev := ParseEvent(first); ev.Type != EventNone || ev.N != 0 {
+		t.Fatalf("first chunk: ParseEvent returned %+v, want EventNone with N 0", ev)
+	}
+
+	buf := append(append([]byte(nil), first...), second...)
+	event = Event{Type: EventKey}
+	if status := extract_event(buf, &event, true); status != event_extracted ||
+		event.Ch != '€' || event.N != len(euro) {
+		t.Fatalf("second chunk: got status %d with %+v, want %q", status, event, '€')
+	}
+}
+
+func TestEightBitAlt(t *testing.T) {
+	mode := input_mode
+	input_mode = InputAlt
+	defer func() { input_mode = mode }()
+
+	for c := 'a'; c <= 'z'; c++ {
+		data := []byte{0x80 | byte(c)}
+		var event Event
+		if status := extract_event(data, &event, true); utf8.FullRune(data) {
+			if status != event_extracted {
+				t.Errorf("Alt+%c: got status %d, want event_extracted", c, status)
+			}
+		} else if status != esc_wait {
+			t.Errorf("Alt+%c: got status %d while waiting is allowed, want esc_wait", c, status)
+		}
+		ev := ParseEvent(data)
+		if ev.Type != EventKey || ev.Ch != c || ev.Key != 0 || ev.Mod != ModAlt || ev.N != 1 {
+			t.Errorf("Alt+%c: ParseEvent(%q) returned %+v", c, data, ev)
+		}
+
+		// the ESC prefix encoding
+		data = []byte{'\033', byte(c)}
+		ev = ParseEvent(data)
+		if ev.Type != EventKey || ev.Ch != c || ev.Key != 0 || ev.Mod != ModAlt || ev.N != 2 {
+			t.Errorf("Alt+%c: ParseEvent(%q) returned %+v", c, data, ev)
+		}
+	}
+}
+
+
+func TestModesWhileSuspended(t *testing.T) {
+	out := init_test_writer(t, 10, 5)
+	Suspend()
+	out.Reset()
+	SetInputMode(InputEsc | InputMouse)
+	SetKeypadMode(false)
+	if err := FlushOutput(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("sent %q while suspended, want nothing", out.String())
+	}
+
+	if err := Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(funcs[t_enter_mouse])) {
+		t.Errorf("Resume sent %q, want it to enable the mouse", out.String())
+	}
+	if bytes.Contains(out.Bytes(), []byte(funcs[t_enter_keypad])) {
+		t.Errorf("Resume sent %q, want the keypad in the numeric mode", out.String())
+	}
+}
+
+func TestLinuxConsoleKeepsBold(t *testing.T) {
+	init_test_writer(t, 2, 1)
+	linux_console = true
+	defer func() { linux_console = false }()
+	SetOutputMode(OutputNormal)
+
+	// red is drawn bright instead of bold, the default color needs bold
+	SetCell(0, 0, 'x', ColorRed|AttrBold, ColorDefault)
+	SetCell(1, 0, 'y', ColorDefault|AttrBold, ColorDefault)
+	got := render_string(t)
+	i := strings.IndexByte(got, 'x')
+	if i == -1 || !strings.Contains(got[i:], funcs[t_bold]) {
+		t.Errorf("rendered %q, want bold turned on after %q", got, 'x')
+	}
+}
+
+func TestFunctionKeysAfterMouse(t *testing.T) {
+	if MouseLeft != 0xFFFF-23 || MouseWheelDown != 0xFFFF-28 {
+		t.Errorf("the values of the mouse keys changed")
+	}
+	init_test_writer(t, 1, 1)
+	for _, tt := range []struct {
+		seq string
+		key Key
+	}{
+		{"\033OP", KeyF1},
+		{"\033OC", KeyArrowRight},
+		{"\033[1;2P", KeyF13},
+		{"\033[24;2~", KeyF24},
+	} {
+		ev := ParseEvent([]byte(tt.seq))
+		if ev.Type != EventKey || ev.Key != tt.key || ev.N != len(tt.seq) {
+			t.Errorf("ParseEvent(%q) returned %+v, want key %d", tt.seq, ev, tt.key)
+		}
+	}
+}
+
+func TestExtendedMouseStopsAtFinalByte(t *testing.T) {
+	init_test_writer(t, 1, 1)
+	for _, tt := range []struct {
+		seq, rest string
+		key       Key
+		x, y      int
+	}{
+		// xterm 1006
+		{"\033[<0;10;5M", "abc", MouseLeft, 9, 4},
+		{"\033[<2;1;1M", "M", MouseRight, 0, 0},
+		{"\033[<0;10;5m", "x", MouseRelease, 9, 4},
+		{"\033[<64;3;4M", "\033[A", MouseWheelUp, 2, 3},
+		{"\033[<0;1;2M", "\033[<0;3;4M", MouseLeft, 0, 1},
+		// urxvt 1015
+		{"\033[32;10;5M", "x", MouseLeft, 9, 4},
+		{"\033[33;100;200M", ";1M", MouseMiddle, 99, 199},
+		{"\033[35;1;1M", "\033[32;2;2M", MouseRelease, 0, 0},
+	} {
+		var event Event
+		status := extract_event([]byte(tt.seq+tt.rest), &event, true)
+		if status != event_extracted || event.Type != EventMouse || event.Key != tt.key ||
+			event.MouseX != tt.x || event.MouseY != tt.y || event.N != len(tt.seq) {
+			t.Errorf("%q followed by %q: got status %d with %+v", tt.seq, tt.rest, status, event)
+		}
+	}
+}
+
+func TestBracketedPaste(t *testing.T) {
+	init_test_writer(t, 1, 1)
+	SetInputMode(InputEsc | InputPaste)
+
+	for _, tt := range []struct {
+		name   string
+		chunks []string
+		paste  string
+	}{
+		{"split", []string{"\033[200~hel", "lo", " world\033[201~"}, "hello world"},
+		{"split end", []string{"\033[200~text\033[20", "1~"}, "text"},
+		{"with ESC", []string{"\033[200~a\033b\033[Ac\033", "[201~"}, "a\033b\033[Ac"},
+	} {
+		var buf []byte
+		var event Event
+		status := event_not_extracted
+		for i, chunk := range tt.chunks {
+			if i > 0 && (status != event_not_extracted || event.N != 0) {
+				t.Fatalf("%s: got status %d with N %d before the whole paste arrived",
+					tt.name, status, event.N)
+			}
+			buf = append(buf, chunk...)
+			event = Event{Type: EventKey}
+			status = extract_event(buf, &event, true)
+		}
+		if status != event_extracted || event.Type != EventPaste ||
+			event.Paste != tt.paste || event.N != len(buf) {
+			t.Errorf("%s: got status %d with paste %q (N %d), want %q",
+				tt.name, status, event.Paste, event.N, tt.paste)
+		}
+	}
+}
+
+func TestModifiedKeys(t *testing.T) {
+	init_test_writer(t, 1, 1)
+	for _, tt := range []struct {
+		seq string
+		key Key
+		ch  rune
+		mod Modifier
+	}{
+		{"\033[1;2A", KeyArrowUp, 0, ModShift},
+		{"\033[1;3B", KeyArrowDown, 0, ModAlt},
+		{"\033[1;4C", KeyArrowRight, 0, ModShift | ModAlt},
+		{"\033[1;5D", KeyArrowLeft, 0, ModCtrl},
+		{"\033[1;6A", KeyArrowUp, 0, ModCtrl | ModShift},
+		{"\033[1;7H", KeyHome, 0, ModCtrl | ModAlt},
+		{"\033[1;8F", KeyEnd, 0, ModCtrl | ModAlt | ModShift},
+		{"\033[1;9C", KeyArrowRight, 0, ModAlt}, // meta
+		{"\033[3;5~", KeyDelete, 0, ModCtrl},
+		{"\033[5;3~", KeyPgup, 0, ModAlt},
+		{"\033[2;2~", KeyInsert, 0, ModShift},
+		// keypad and the cursor keys terminfo doesn't describe
+		{"\033[A", KeyArrowUp, 0, 0},
+		{"\033OM", KeyEnter, 0, 0},
+		{"\033Op", 0, '0', 0},
+		{"\033Oy", 0, '9', 0},
+		{"\033Ok", 0, '+', 0},
+		{"\033OX", 0, '=', 0},
+	} {
+		data := []byte(tt.seq + "x")
+		ev := ParseEvent(data)
+		if ev.Type != EventKey || ev.Key != tt.key || ev.Ch != tt.ch ||
+			ev.Mod != tt.mod || ev.N != len(tt.seq) {
+			t.Errorf("ParseEvent(%q) returned %+v, want key %d, rune %q and mod %d",
+				data, ev, tt.key, tt.ch, tt.mod)
+		}
+	}
+}
+
+func TestScrollRegion(t *testing.T) {
+	init_test_writer(t, 3, 4)
+	fill := Cell{Ch: '.'}
+	for _, tt := range []struct {
+		name          string
+		x, y, w, h, n int
+		want          []string
+	}{
+		{"up", 0, 0, 3, 4, 1, []string{"bbb", "ccc", "ddd", "..."}},
+		{"down", 0, 0, 3, 4, -2, []string{"...", "...", "aaa", "bbb"}},
+		{"inner up", 1, 1, 1, 3, 1, []string{"aaa", "bcb", "cdc", "d.d"}},
+		{"inner down", 0, 1, 2, 2, -1, []string{"aaa", "..b", "bbc", "ddd"}},
+		{"clipped", 1, -1, 10, 3, 1, []string{"abb", "b..", "ccc", "ddd"}},
+		{"clipped down", -5, 2, 7, 5, -1, []string{"aaa", "bbb", "..c", "ccd"}},
+		{"all up", 0, 0, 3, 4, 4, []string{"...", "...", "...", "..."}},
+		{"all down", 0, 1, 3, 2, -5, []string{"aaa", "...", "...", "ddd"}},
+		{"none", 0, 0, 3, 4, 0, []string{"aaa", "bbb", "ccc", "ddd"}},
+		{"outside", 3, 0, 3, 4, 1, []string{"aaa", "bbb", "ccc", "ddd"}},
+	} {
+		set_rows("aaa", "bbb", "ccc", "ddd")
+		ScrollRegion(tt.x, tt.y, tt.w, tt.h, tt.n, fill)
+		check_rows(t, tt.name, tt.want...)
+	}
+}
+
+func TestCopyRegion(t *testing.T) {
+	init_test_writer(t, 3, 3)
+	for _, tt := range []struct {
+		name                 string
+		sx, sy, w, h, dx, dy int
+		want                 []string
+	}{
+		{"overlapping down", 0, 0, 3, 2, 0, 1, []string{"abc", "abc", "def"}},
+		{"overlapping right", 0, 0, 2, 3, 1, 0, []string{"aab", "dde", "ggh"}},
+		{"overlapping up", 0, 1, 3, 2, 0, 0, []string{"def", "ghi", "ghi"}},
+		{"negative source", -1, -1, 3, 3, 0, 0, []string{"abc", "dab", "gde"}},
+		{"clipped destination", 0, 0, 3, 3, 2, 2, []string{"abc", "def", "gha"}},
+		{"negative destination", 1, 1, 3, 3, -1, -1, []string{"ibc", "def", "ghi"}},
+	} {
+		set_rows("abc", "def", "ghi")
+		CopyRegion(tt.sx, tt.sy, tt.w, tt.h, tt.dx, tt.dy)
+		check_rows(t, tt.name, tt.want...)
+	}
+}
+
+func TestPrintWrapped(t *testing.T) {
+	init_test_writer(t, 7, 3)
+	SetTabWidth(4)
+	t.Cleanup(func() { SetTabWidth(8) })
+
+	for _, tt := range []struct {
+		name string
+		s    string
+		rows int
+		want []string
+	}{
+		{"fits", "ab cd", 1, []string{" ab cd ", "       ", "       "}},
+		{"wrap at space", "ab cd ef", 2, []string{" ab cd ", " ef    ", "       "}},
+		{"long word", "abcdefghijkl", 3, []string{" abcde ", " fghij ", " kl    "}},
+		{"word after long word", "abcdefg hi", 2, []string{" abcde ", " fg hi ", "       "}},
+		{"spaces after wrap", "abcde   fg", 2, []string{" abcde ", " fg    ", "       "}},
+		{"space at the edge", "abcd efg", 2, []string{" abcd  ", " efg   ", "       "}},
+		{"tab", "a\tb", 1, []string{" a   b ", "       ", "       "}},
+		{"tab at the wrap column", "abcd\tef", 2, []string{" abcd  ", " ef    ", "       "}},
+		{"newline", "ab\ncd", 2, []string{" ab    ", " cd    ", "       "}},
+		{"trailing newline", "ab\n", 2, []string{" ab    ", "       ", "       "}},
+		{"clipped", "ab cd ef gh ij kl mn", 4, []string{" ab cd ", " ef gh ", " ij kl "}},
+	} {
+		Clear(ColorDefault, ColorDefault)
+		if n := PrintWrapped(1, 0, 5, ColorDefault, ColorDefault, tt.s); n != tt.rows {
+			t.Errorf("%s: PrintWrapped returned %d rows, want %d", tt.name, n, tt.rows)
+		}
+		check_rows(t, tt.name, tt.want...)
+	}
+}
+
+func TestViewPrintExpandsTabs(t *testing.T) {
+	init_test_writer(t, 10, 1)
+	SetTabWidth(4)
+	t.Cleanup(func() { SetTabWidth(8) })
+
+	v := NewView(Rect{2, 0, 7, 1})
+	if x := v.Print(0, 0, ColorDefault, ColorDefault, "a\tb\tc"); x != 9 {
+		t.Errorf("Print returned %d, want 9", x)
+	}
+	// the text beyond the view is clipped
+	check_rows(t, "View.Print", "  a   b   ")
+
+	Clear(ColorDefault, ColorDefault)
+	PrintFunc(2, 0, "a\tb", func(int, rune) (Attribute, Attribute) {
+		return ColorDefault, ColorDefault
+	})
+	check_rows(t, "PrintFunc", "  a   b   ")
+}
+
+func TestVisualBell(t *testing.T) {
+	out := init_test_writer(t, 10, 1)
+
+	// xterm's flash turns on reverse video for 100ms
+	out.Reset()
+	start := time.Now()
+	if err := VisualBell(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "\033[?5h\033[?5l"; got != want {
+		t.Errorf("VisualBell wrote %q, want %q", got, want)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("VisualBell returned after %v, the delay of the flash is 100ms", d)
+	}
+
+	// terminals without flash get the bell
+	orig := funcs
+	defer func() { funcs = orig }()
+	funcs = append([]string(nil), orig...)
+	funcs[t_flash] = ""
+	out.Reset()
+	if err := VisualBell(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "\007" {
+		t.Errorf("VisualBell wrote %q without flash, want the bell", got)
+	}
+}
@@ -1,9 +1,11 @@
 package termbox
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"syscall"
-
-	"github.com/mattn/go-runewidth"
+	"time"
 )
 
 // public API
@@ -18,30 +20,38 @@ import (
 //      }
 //      defer termbox.Close()
 func Init() error {
+	return InitWithOptions(InitOptions{})
+}
+
+// Same as Init, but allows to change the settings which have to be chosen
+// before the terminal is set up, see InitOptions. Windows console has neither
+// an alternate screen nor signals and supports only OutputNormal, so
+// NoAltScreen, NoSignals, OutputMode and EscDelay are ignored.
+func InitWithOptions(opts InitOptions) error {
 	var err error
 
 	interrupt, err = create_event()
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to create the interrupt event: %w", err)
 	}
 
 	in, err = syscall.Open("CONIN$", syscall.O_RDWR, 0)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to open CONIN$: %w", err)
 	}
 	out, err = syscall.Open("CONOUT$", syscall.O_RDWR, 0)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to open CONOUT$: %w", err)
 	}
 
 	err = get_console_mode(in, &orig_mode)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to get the console mode: %w", err)
 	}
 
 	err = set_console_mode(in, enable_window_input)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to set the console mode: %w", err)
 	}
 
 	orig_size, orig_window = get_term_size(out)
@@ -49,17 +59,17 @@ func Init() error {
 
 	err = set_console_screen_buffer_size(out, win_size)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to set the console buffer size: %w", err)
 	}
 
 	err = fix_win_size(out, win_size)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to set the console window size: %w", err)
 	}
 
 	err = get_console_cursor_info(out, &orig_cursor_info)
 	if err != nil {
-		return err
+		return fmt.Errorf("termbox: failed to get the console cursor info: %w", err)
 	}
 
 	show_cursor(false)
@@ -71,6 +81,8 @@ func Init() error {
 	clear()
 
 	diffbuf = make([]diff_msg, 0, 32)
+	caps = TerminalCapabilities{Colors: 8, Mouse: true}
+	set_input_mode(opts.InputMode)
 
 	go input_event_producer()
 	IsInit = true
@@ -79,28 +91,44 @@ func Init() error {
 
 // Finalizes termbox library, should be called after successful initialization
 // when termbox's functionality isn't required anymore.
+// Calling it again, or without initialization, does nothing.
 func Close() {
+	stop_events()
+	drop_injected()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !IsInit {
+		return
+	}
+	stop_close_signals()
+
 	// we ignore errors here, because we can't really do anything about them
-	Clear(0, 0)
-	Flush()
-
-	// stop event producer
-	cancel_comm <- true
-	set_event(interrupt)
-	select {
-	case <-input_comm:
-	default:
+	if !suspended {
+		foreground, background = 0, 0
+		update_size_maybe()
+		back_buffer.clear()
+		present()
+		stop_input()
 	}
-	<-cancel_done_comm
 
 	set_console_screen_buffer_size(out, orig_size)
 	set_console_window_info(out, &orig_window)
 	set_console_cursor_info(out, &orig_cursor_info)
 	set_console_cursor_position(out, coord{})
 	set_console_mode(in, orig_mode)
+	if orig_title != nil {
+		set_console_title(&orig_title[0])
+		orig_title = nil
+	}
 	syscall.Close(in)
 	syscall.Close(out)
 	syscall.Close(interrupt)
+	cursor_size = 100
+	cells_exposed = false
+	resize_pending = false
+	suspended = false
+	caps = TerminalCapabilities{}
 	IsInit = false
 }
 
@@ -111,49 +139,20 @@ func Interrupt() {
 	interrupt_comm <- struct{}{}
 }
 
-// Synchronizes the internal back buffer with the terminal.
+// Synchronizes the internal back buffer with the terminal. Returns the error
+// of writing to the terminal, if any, e.g. when the terminal went away.
 func Flush() error {
-	update_size_maybe()
-	prepare_diff_messages()
-	for _, diff := range diffbuf {
-		chars := []char_info{}
-		for _, char := range diff.chars {
-			chars = append(chars, char)
-			if runewidth.RuneWidth(rune(char.char)) > 1 {
-				chars = append(chars, char_info{
-					char: ' ',
-					attr: char.attr,
-				})
-			}
-		}
-		r := small_rect{
-			left:   0,
-			top:    diff.pos,
-			right:  term_size.x - 1,
-			bottom: diff.pos + diff.lines - 1,
-		}
-		write_console_output(out, chars, r)
-	}
-	if !is_cursor_hidden(cursor_x, cursor_y) {
-		move_cursor(cursor_x, cursor_y)
-	}
-	return nil
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	return present()
 }
 
 // Sets the position of the cursor. See also HideCursor().
 func SetCursor(x, y int) {
-	if is_cursor_hidden(cursor_x, cursor_y) && !is_cursor_hidden(x, y) {
-		show_cursor(true)
-	}
-
-	if !is_cursor_hidden(cursor_x, cursor_y) && is_cursor_hidden(x, y) {
-		show_cursor(false)
-	}
-
-	cursor_x, cursor_y = x, y
-	if !is_cursor_hidden(cursor_x, cursor_y) {
-		move_cursor(cursor_x, cursor_y)
-	}
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	set_cursor(x, y)
 }
 
 // The shortcut for SetCursor(-1, -1).
@@ -161,34 +160,117 @@ func HideCursor() {
 	SetCursor(cursor_hidden, cursor_hidden)
 }
 
-// Changes cell's parameters in the internal back buffer at the specified
-// position.
-func SetCell(x, y int, ch rune, fg, bg Attribute) {
-	if x < 0 || x >= back_buffer.width {
+// Sets the shape of the cursor. Windows console supports only the cursor
+// height, block styles are drawn as a full block, underline and bar styles as
+// a thin line and blinking can't be controlled. CursorDefault restores the
+// default cursor.
+func SetCursorStyle(style CursorStyle) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	switch style {
+	case CursorDefault, CursorBlockBlink, CursorBlockSteady:
+		cursor_size = 100
+	case CursorUnderlineBlink, CursorUnderlineSteady, CursorBarBlink, CursorBarSteady:
+		cursor_size = 15
+	default:
 		return
 	}
-	if y < 0 || y >= back_buffer.height {
+	if !is_cursor_hidden(cursor_x, cursor_y) {
+		show_cursor(true)
+	}
+}
+
+// Sets the title of the console window. The original title is restored by
+// Close.
+func SetTitle(title string) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if orig_title == nil {
+		buf := make([]uint16, 1024)
+		n := get_console_title(buf)
+		orig_title = buf[:n+1]
+	}
+	p, err := syscall.UTF16PtrFromString(title)
+	if err != nil {
 		return
 	}
+	set_console_title(p)
+}
+
+// Rings the bell, plays the default system sound.
+func Beep() error {
+	r0, _, err := message_beep.Call(0xFFFFFFFF)
+	if r0 == 0 {
+		return err
+	}
+	return nil
+}
+
+// The console can't flash, rings the bell like Beep.
+func VisualBell() error {
+	return Beep()
+}
+
+// Writes the buffered output to the terminal. The console functions used on
+// windows are not buffered, so this function does nothing.
+func FlushOutput() error {
+	return nil
+}
+
+// Sends the bytes to the terminal as they are. Windows console is not
+// controlled by escape sequences, so this function does nothing.
+func RawWrite(b []byte) {
+}
+
+// Returns the position of the console cursor. Note that the cursor is only
+// where SetCursor put it after a Flush.
+func QueryCursorPosition() (x, y int, err error) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	var info console_screen_buffer_info
+	err = get_console_screen_buffer_info(out, &info)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(info.cursor_position.x), int(info.cursor_position.y), nil
+}
+
+// Puts the text into the system clipboard. Not supported on windows yet,
+// always returns an error.
+func SetClipboard(text string) error {
+	return errors.New("termbox: SetClipboard is not supported on windows")
+}
 
-	back_buffer.cells[y*back_buffer.width+x] = Cell{ch, fg, bg}
+// Sets how long PollEvent waits for the rest of an escape sequence after a
+// lone ESC. Windows console reports keys as separate events, there are no
+// escape sequences to wait for, so this function does nothing.
+func SetEscDelay(d time.Duration) {
 }
 
 // Returns a slice into the termbox's back buffer. You can get its dimensions
 // using 'Size' function. The slice remains valid as long as no 'Clear' or
-// 'Flush' function calls were made after call to this function.
+// 'Flush' function calls were made after call to this function. These resize
+// the back buffer when the terminal size has changed, so fetch the slice and
+// the size again after each of them, EventResize in particular means the old
+// slice is stale. Cells modified directly through the slice keep their
+// combining characters, see SetCellWithCombining. Once the slice was taken,
+// Flush compares the whole buffer instead of only the rows changed through
+// SetCell and friends.
 func CellBuffer() []Cell {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	cells_exposed = true
 	return back_buffer.cells
 }
 
 // Wait for an event and return it. This is a blocking function call.
 func PollEvent() Event {
-	select {
-	case ev := <-input_comm:
-		return ev
-	case <-interrupt_comm:
-		return Event{Type: EventInterrupt}
-	}
+	event, _ := poll_event(nil)
+	return event
 }
 
 // Returns the size of the internal back buffer (which is mostly the same as
@@ -196,11 +278,31 @@ func PollEvent() Event {
 // of the console window, after the console size has changed, the internal back
 // buffer will get in sync only after Clear or Flush function calls.
 func Size() (int, int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
 	return int(term_size.x), int(term_size.y)
 }
 
+// Writes the contents of the internal back buffer to 'w' as text with the
+// escape sequences for the colors and attributes. Windows console is not
+// driven by escape sequences, so this function is not supported on windows
+// and returns an error.
+func RenderTo(w io.Writer) error {
+	return errors.New("termbox: RenderTo is not supported on windows")
+}
+
+// Sets the size of the buffers, overriding the size of the terminal. Windows
+// console buffers always have the size of the console window, so this
+// function does nothing.
+func SetSize(w, h int) {
+}
+
 // Clears the internal back buffer.
 func Clear(fg, bg Attribute) error {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
 	foreground, background = fg, bg
 	update_size_maybe()
 	back_buffer.clear()
@@ -216,30 +318,59 @@ func Clear(fg, bg Attribute) error {
 // any known sequence. ESC enables ModAlt modifier for the next keyboard event.
 //
 // Both input modes can be OR'ed with Mouse mode. Setting Mouse mode bit up will
-// enable mouse button press/release and drag events.
+// enable mouse button press/release and drag events. Drag events have the
+// ModMotion modifier set.
+//
+// Mouse mode can be further OR'ed with MouseMotion mode, which enables
+// reporting of the mouse movement when no button is pressed. These events are
+// reported as MouseRelease with the ModMotion modifier set. MouseMotion mode
+// has no effect without Mouse mode.
+//
+// Paste mode is accepted, but has no effect on windows, pasted text is always
+// reported as key events.
+//
+// Focus mode can be OR'ed too, an EventFocus event is reported when the
+// console window gains or loses focus.
+//
+// Coalesce mode merges identical key events which are ready at the same time,
+// e.g. when a key is held down and the application can't keep up, into one
+// event with the 'Repeat' field set to their number. Without it every key
+// press is a separate event and 'Repeat' is 0.
 //
 // If 'mode' is InputCurrent, returns the current input mode. See also Input*
 // constants.
 func SetInputMode(mode InputMode) InputMode {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
 	if mode == InputCurrent {
 		return input_mode
 	}
-	if mode&InputMouse != 0 {
-		err := set_console_mode(in, enable_window_input|enable_mouse_input|enable_extended_flags)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		err := set_console_mode(in, enable_window_input)
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	input_mode = mode
+	set_input_mode(mode)
 	return input_mode
 }
 
+// Changes the color the terminal displays for the palette entry 'index'.
+// Palette changes are not supported on windows, this function does nothing.
+func SetPaletteColor(index int, r, g, b uint8) {
+}
+
+// Restores the terminal's default palette. Palette changes are not supported
+// on windows, this function does nothing.
+func ResetPalette() {
+}
+
+// Changes the terminal's default foreground and background colors. Not
+// supported on windows, this function does nothing.
+func SetDefaultColors(fg, bg Attribute) {
+}
+
+// Switches the keypad between the application and the numeric mode. Windows
+// console has no keypad modes, the keypad always produces digits, so this
+// function does nothing.
+func SetKeypadMode(application bool) {
+}
+
 // Sets the termbox output mode.
 //
 // Windows console does not support extra colour modes,
@@ -248,10 +379,75 @@ func SetOutputMode(mode OutputMode) OutputMode {
 	return OutputNormal
 }
 
+// Temporarily gives the console back, e.g. to run an editor or a shell in it:
+// clears the screen, restores the original console modes and stops reading the
+// input. The buffers and the settings are kept, Resume takes the console over
+// again. Flush does nothing while suspended, SetInputMode only records the
+// mode, which Resume enables. Does nothing if already suspended.
+func Suspend() {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !IsInit || suspended {
+		return
+	}
+	stop_input()
+	clear()
+	set_console_screen_buffer_size(out, orig_size)
+	set_console_window_info(out, &orig_window)
+	set_console_cursor_info(out, &orig_cursor_info)
+	set_console_cursor_position(out, coord{})
+	set_console_mode(in, orig_mode)
+	suspended = true
+}
+
+// Takes the console over again after Suspend and redraws the whole screen.
+// Does nothing if not suspended.
+func Resume() error {
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if !suspended {
+		return nil
+	}
+	err := set_console_mode(in, input_console_mode())
+	if err != nil {
+		return err
+	}
+	win_size := get_win_size(out)
+	err = set_console_screen_buffer_size(out, win_size)
+	if err != nil {
+		return err
+	}
+	err = fix_win_size(out, win_size)
+	if err != nil {
+		return err
+	}
+	show_cursor(!is_cursor_hidden(cursor_x, cursor_y))
+	go input_event_producer()
+	suspended = false
+
+	front_buffer.clear()
+	back_buffer.mark_dirty(0, back_buffer.height)
+	clear()
+	return present()
+}
+
 // Sync comes handy when something causes desync between termbox's understanding
 // of a terminal buffer and the reality. Such as a third party process. Sync
 // forces a complete resync between the termbox and a terminal, it may not be
-// visually pretty though. At the moment on Windows it does nothing.
+// visually pretty though.
 func Sync() error {
-	return nil
+	defer call_resize_funcs()
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if suspended {
+		return nil
+	}
+	front_buffer.clear()
+	back_buffer.mark_dirty(0, back_buffer.height)
+	clear()
+	return present()
 }
@@ -0,0 +1,66 @@
+package termbox
+
+// offscreen buffers, common OS agnostic part
+
+// An offscreen buffer of cells, e.g. a layer of the user interface. Buffers
+// are drawn on top of each other using Compose and onto the internal back
+// buffer using DrawBuffer, drawing the layers from the bottom to the top gives
+// z-ordering. Cells with zero 'Ch' are transparent.
+//
+// Unlike the internal back buffer, a Buffer is not safe for concurrent use.
+type Buffer struct {
+	buf cellbuf
+}
+
+// Creates a new buffer 'w' by 'h' cells. Initially all of its cells are
+// transparent.
+func NewBuffer(w, h int) *Buffer {
+	b := new(Buffer)
+	b.buf.init(max_int(w, 0), max_int(h, 0))
+	return b
+}
+
+// Returns the size of the buffer.
+func (this *Buffer) Size() (int, int) {
+	return this.buf.width, this.buf.height
+}
+
+// Changes cell's parameters in the buffer at the specified position. Positions
+// outside of the buffer are ignored.
+func (this *Buffer) SetCell(x, y int, ch rune, fg, bg Attribute) {
+	this.buf.set(x, y, ch, fg, bg)
+}
+
+// Returns the cell of the buffer at the specified position. Returns false if
+// the position is outside of the buffer.
+func (this *Buffer) GetCell(x, y int) (Cell, bool) {
+	if x < 0 || x >= this.buf.width {
+		return Cell{}, false
+	}
+	if y < 0 || y >= this.buf.height {
+		return Cell{}, false
+	}
+
+	return this.buf.cells[y*this.buf.width+x], true
+}
+
+// Fills the buffer with the given cell, a zero Cell makes it transparent
+// again.
+func (this *Buffer) Fill(cell Cell) {
+	this.buf.fill(this.buf.bounds(), cell)
+}
+
+// Draws 'src' on top of 'dst' with the top-left corner of 'src' at 'x', 'y'.
+// Transparent cells of 'src' leave the cells of 'dst' under them untouched.
+// Parts of 'src' which lie outside of 'dst' are clipped.
+func Compose(dst, src *Buffer, x, y int) {
+	dst.buf.compose(&src.buf, x, y)
+}
+
+// Same as Compose, but draws 'src' onto the internal back buffer.
+func DrawBuffer(src *Buffer, x, y int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.compose(&src.buf, x, y)
+}
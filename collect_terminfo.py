@@ -23,7 +23,9 @@ terminals = {
 	'rxvt-unicode' : 'rxvt_unicode',
 	'linux' : 'linux',
 	'Eterm' : 'eterm',
-	'screen' : 'screen'
+	'screen' : 'screen',
+	'tmux' : 'tmux',
+	'vt100' : 'vt100'
 }
 
 keys = [
@@ -48,7 +50,19 @@ keys = [
 	"KEY_UP",	"kcuu1",
 	"KEY_DOWN",	"kcud1",
 	"KEY_LEFT",	"kcub1",
-	"KEY_RIGHT",	"kcuf1"
+	"KEY_RIGHT",	"kcuf1",
+	"F13",		"kf13",
+	"F14",		"kf14",
+	"F15",		"kf15",
+	"F16",		"kf16",
+	"F17",		"kf17",
+	"F18",		"kf18",
+	"F19",		"kf19",
+	"F20",		"kf20",
+	"F21",		"kf21",
+	"F22",		"kf22",
+	"F23",		"kf23",
+	"F24",		"kf24"
 ]
 
 funcs = [
@@ -62,6 +76,8 @@ funcs = [
 	"T_BOLD",		"bold",
 	"T_BLINK",		"blink",
 	"T_REVERSE",            "rev",
+	"T_DIM",		"dim",
+	"T_ITALIC",		"sitm",
 	"T_ENTER_KEYPAD",	"smkx",
 	"T_EXIT_KEYPAD",	"rmkx"
 ]
@@ -0,0 +1,265 @@
+package termbox
+
+// drawing helpers, common OS agnostic part
+
+import (
+	"strings"
+	"unicode"
+)
+
+type BorderStyle int
+
+// Border style. See DrawBox function.
+const (
+	BorderSingle BorderStyle = iota
+	BorderDouble
+	BorderRounded
+)
+
+// corners (top-left, top-right, bottom-left, bottom-right), horizontal and
+// vertical lines for each of the border styles
+var border_runes = [...][6]rune{
+	BorderSingle:  {'┌', '┐', '└', '┘', '─', '│'},
+	BorderDouble:  {'╔', '╗', '╚', '╝', '═', '║'},
+	BorderRounded: {'╭', '╮', '╰', '╯', '─', '│'},
+}
+
+// tab stops are every 'tab_width' columns, see SetTabWidth
+var tab_width = 8
+
+// Sets the distance between tab stops the string drawing functions (e.g.
+// PrintWrapped) expand '\t' to, in cells. The default is 8. Values less than 1
+// are treated as 1.
+func SetTabWidth(n int) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	tab_width = max_int(n, 1)
+}
+
+// Draws a box 'w' by 'h' cells with the top-left corner at 'x', 'y' into the
+// internal back buffer. Only the border is drawn, the inside of the box is left
+// untouched. Parts of the box outside of the buffer are clipped.
+func DrawBox(x, y, w, h int, fg, bg Attribute, style BorderStyle) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if w <= 0 || h <= 0 {
+		return
+	}
+	if style < 0 || int(style) >= len(border_runes) {
+		style = BorderSingle
+	}
+	b := &border_runes[style]
+	x2, y2 := x+w-1, y+h-1
+
+	put_line(x+1, y, w-2, 1, 0, b[4], fg, bg)
+	put_line(x+1, y2, w-2, 1, 0, b[4], fg, bg)
+	put_line(x, y+1, h-2, 0, 1, b[5], fg, bg)
+	put_line(x2, y+1, h-2, 0, 1, b[5], fg, bg)
+	put_clipped(x, y, b[0], fg, bg)
+	put_clipped(x2, y, b[1], fg, bg)
+	put_clipped(x, y2, b[2], fg, bg)
+	put_clipped(x2, y2, b[3], fg, bg)
+}
+
+// Fills 'length' cells of a row starting at 'x', 'y' and going right with the
+// rune in the internal back buffer. Cells outside of the buffer are clipped.
+// A wide rune takes two cells, so 'length' / 2 of them are put.
+func HLine(x, y, length int, r rune, fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	rw := max_int(RuneWidth(r), 1)
+	put_line(x, y, length/rw, rw, 0, r, fg, bg)
+}
+
+// Fills 'length' cells of a column starting at 'x', 'y' and going down with
+// the rune in the internal back buffer. Cells outside of the buffer are
+// clipped.
+func VLine(x, y, length int, r rune, fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	put_line(x, y, length, 0, 1, r, fg, bg)
+}
+
+func put_clipped(x, y int, r rune, fg, bg Attribute) {
+	if x >= 0 && x < back_buffer.width && y >= 0 && y < back_buffer.height {
+		set_cell(x, y, r, fg, bg)
+	}
+}
+
+// Puts 'length' copies of the rune starting at 'x', 'y' and moving by 'dx',
+// 'dy' after each one.
+func put_line(x, y, length, dx, dy int, r rune, fg, bg Attribute) {
+	for i := 0; i < length; i++ {
+		put_clipped(x+i*dx, y+i*dy, r, fg, bg)
+	}
+}
+
+// Prints the string into the internal back buffer within the region starting
+// at 'x', 'y' and 'w' cells wide, wrapping the lines at spaces. Words longer
+// than 'w' are broken at the region's edge. '\n' starts a new line, '\t'
+// advances to the next tab stop counted from 'x' (see SetTabWidth), filling
+// the cells with spaces. Returns the number of rows used, parts of the text
+// outside of the buffer are clipped.
+func PrintWrapped(x, y, w int, fg, bg Attribute, s string) int {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if w <= 0 || s == "" {
+		return 0
+	}
+
+	p := printer{x: x, y: y, w: w, fg: fg, bg: bg, last: -1, clip: back_buffer.bounds()}
+	for i, line := range strings.Split(s, "\n") {
+		if i != 0 {
+			p.newline()
+		}
+		p.print_wrapped(line)
+	}
+	return p.row + 1
+}
+
+// Prints the string into a single row of the internal back buffer starting at
+// 'x', 'y', with the attributes of each rune given by 'attr', e.g. for syntax
+// highlighting. 'attr' is called with the byte offset of the rune in 's' and
+// the rune itself, before anything is drawn, so it may use the API. '\t'
+// advances to the next tab stop counted from 'x' (see SetTabWidth), zero width
+// runes are attached to the previous cell and other control characters are
+// skipped. Returns the column after the last rune, for printing more text
+// right after it. Parts of the text outside of the buffer are clipped.
+func PrintFunc(x, y int, s string, attr func(i int, r rune) (fg, bg Attribute)) int {
+	type styled_rune struct {
+		r      rune
+		fg, bg Attribute
+	}
+	runes := make([]styled_rune, 0, len(s))
+	for i, r := range s {
+		fg, bg := attr(i, r)
+		runes = append(runes, styled_rune{r, fg, bg})
+	}
+
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	p := printer{x: x, y: y, last: -1, clip: back_buffer.bounds()}
+	for _, sr := range runes {
+		p.fg, p.bg = sr.fg, sr.bg
+		p.print_rune(sr.r)
+	}
+	return x + p.col
+}
+
+// State of PrintWrapped, PrintFunc and View.Print, the position is relative to
+// the region.
+type printer struct {
+	x, y, w int
+	fg, bg  Attribute
+	row     int
+	col     int
+	wrapped bool // the current row was started by wrapping
+	last    int  // back buffer index of the last printed cell or -1
+	clip    Rect // runes which don't fit into it completely are not drawn
+}
+
+func (this *printer) newline() {
+	this.row++
+	this.col = 0
+	this.wrapped = false
+	this.last = -1
+}
+
+func (this *printer) wrap() {
+	this.newline()
+	this.wrapped = true
+}
+
+// Puts the rune at the current position and advances it, 'rw' is the width of
+// the rune. Zero width runes are attached to the last printed cell.
+func (this *printer) put(r rune, rw int) {
+	if rw == 0 {
+		if this.last != -1 {
+			extra := &back_buffer.extras[this.last]
+			extra.comb = append(extra.comb[:len(extra.comb):len(extra.comb)], r)
+		}
+		return
+	}
+
+	cx, cy := this.x+this.col, this.y+this.row
+	this.last = -1
+	if cell := (Rect{cx, cy, rw, 1}).Intersect(this.clip); cell.W == rw {
+		set_cell(cx, cy, r, this.fg, this.bg)
+		this.last = cy*back_buffer.width + cx
+	}
+	this.col += rw
+}
+
+// Puts the rune into the current row, '\t' advances to the next tab stop and
+// other control characters are skipped.
+func (this *printer) print_rune(r rune) {
+	switch {
+	case r == '\t':
+		next := (this.col/tab_width + 1) * tab_width
+		for this.col < next {
+			this.put(' ', 1)
+		}
+	case unicode.IsControl(r):
+	default:
+		this.put(r, RuneWidth(r))
+	}
+}
+
+func (this *printer) print_wrapped(line string) {
+	for len(line) > 0 {
+		switch line[0] {
+		case ' ':
+			line = line[1:]
+			if this.col >= this.w {
+				this.wrap()
+			}
+			if this.wrapped && this.col == 0 {
+				// spaces at the wrapping point are dropped
+				continue
+			}
+			this.put(' ', 1)
+		case '\t':
+			line = line[1:]
+			next := (this.col/tab_width + 1) * tab_width
+			if next > this.w {
+				this.wrap()
+				continue
+			}
+			for this.col < next {
+				this.put(' ', 1)
+			}
+		default:
+			end := strings.IndexAny(line, " \t")
+			if end == -1 {
+				end = len(line)
+			}
+			this.print_word(line[:end])
+			line = line[end:]
+		}
+	}
+}
+
+func (this *printer) print_word(word string) {
+	ww := StringWidth(word)
+	if this.col > 0 && this.col+ww > this.w {
+		this.wrap()
+	}
+	for _, r := range word {
+		if unicode.IsControl(r) {
+			continue
+		}
+		rw := RuneWidth(r)
+		if rw > this.w {
+			// doesn't fit at all, e.g. a wide rune into a 1 column region
+			continue
+		}
+		if this.col+rw > this.w {
+			this.wrap()
+		}
+		this.put(r, rw)
+	}
+}
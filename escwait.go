@@ -1,11 +1,13 @@
-// +build !darwin
+// +build !windows,!darwin
 
 package termbox
 
+import "time"
+
 // On all systems other than macOS, disable behavior which will wait before
 // deciding that the escape key was pressed, to account for partially send
 // escape sequences, especially with regard to lengthy mouse sequences.
-// See https://github.com/nsf/termbox-go/issues/132
-func enable_wait_for_escape_sequence() bool {
-	return false
-}
+// See https://github.com/nsf/termbox-go/issues/132 and SetEscDelay.
+const default_esc_delay time.Duration = 0
+
+var esc_delay = default_esc_delay
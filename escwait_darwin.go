@@ -1,9 +1,13 @@
 package termbox
 
+import "time"
+
 // On macOS, enable behavior which will wait before deciding that the escape
 // key was pressed, to account for partially send escape sequences, especially
-// with regard to lengthy mouse sequences.
-// See https://github.com/nsf/termbox-go/issues/132
-func enable_wait_for_escape_sequence() bool {
-	return true
-}
+// with regard to lengthy mouse sequences. This is an arbitrary delay which
+// hopefully will be enough time for any lagging partial escape sequences to
+// come through.
+// See https://github.com/nsf/termbox-go/issues/132 and SetEscDelay.
+const default_esc_delay = 100 * time.Millisecond
+
+var esc_delay = default_esc_delay
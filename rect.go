@@ -0,0 +1,47 @@
+package termbox
+
+// rectangles, common OS agnostic part
+
+// A rectangle of cells with the top-left corner at 'X', 'Y' and the size 'W'
+// by 'H' cells. A rectangle with non-positive 'W' or 'H' is empty.
+type Rect struct {
+	X, Y, W, H int
+}
+
+// Returns true if the rectangle contains no cells.
+func (this Rect) Empty() bool {
+	return this.W <= 0 || this.H <= 0
+}
+
+// Returns the part of the rectangle which lies inside of 'o'. If the
+// rectangles don't overlap, the result is empty.
+func (this Rect) Intersect(o Rect) Rect {
+	x0, y0 := max_int(this.X, o.X), max_int(this.Y, o.Y)
+	x1 := min_int(this.X+this.W, o.X+o.W)
+	y1 := min_int(this.Y+this.H, o.Y+o.H)
+	if x1 <= x0 || y1 <= y0 {
+		return Rect{}
+	}
+	return Rect{x0, y0, x1 - x0, y1 - y0}
+}
+
+// Returns true if the cell at 'x', 'y' lies inside of the rectangle.
+func (this Rect) Contains(x, y int) bool {
+	return x >= this.X && x < this.X+this.W && y >= this.Y && y < this.Y+this.H
+}
+
+// Same as Fill, but the region is given as a rectangle.
+func FillRect(r Rect, cell Cell) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.fill(r, cell)
+}
+
+// Same as ClearRegion, but the region is given as a rectangle.
+func ClearRect(r Rect) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.fill(r, Cell{' ', foreground, background})
+}
@@ -10,6 +10,12 @@ import "strings"
 import "strconv"
 import "os"
 import "io"
+import "time"
+import "runtime"
+import "errors"
+import "sync"
+import "fmt"
+import "os/signal"
 
 // private API
 
@@ -24,8 +30,11 @@ const (
 	t_bold
 	t_blink
 	t_reverse
+	t_dim
+	t_italic
 	t_enter_keypad
 	t_exit_keypad
+	t_flash
 	t_enter_mouse
 	t_exit_mouse
 	t_max_funcs
@@ -33,7 +42,7 @@ const (
 
 const (
 	coord_invalid = -2
-	attr_invalid  = Attribute(0xFFFF)
+	attr_invalid  = ^Attribute(0)
 )
 
 type input_event struct {
@@ -41,6 +50,32 @@ type input_event struct {
 	err  error
 }
 
+// Where the output goes, the terminal or, in headless mode, an arbitrary writer
+// wrapped by writer_output.
+type output interface {
+	io.Writer
+	WriteString(s string) (int, error)
+	Close() error
+	Fd() uintptr
+}
+
+// Output which is not a terminal, see InitWithWriter.
+type writer_output struct {
+	io.Writer
+}
+
+func (this writer_output) WriteString(s string) (int, error) {
+	return io.WriteString(this.Writer, s)
+}
+
+func (this writer_output) Close() error {
+	return nil
+}
+
+func (this writer_output) Fd() uintptr {
+	return ^uintptr(0)
+}
+
 type extract_event_res int
 
 const (
@@ -56,13 +91,21 @@ var (
 
 	// termbox inner state
 	orig_tios      syscall_Termios
+	orig_fl        int
 	back_buffer    cellbuf
 	front_buffer   cellbuf
 	termw          int
 	termh          int
 	input_mode     = InputEsc
 	output_mode    = OutputNormal
-	out            *os.File
+	out            output
+	headless       bool
+	headlessw      int
+	headlessh      int
+	size_lock      sync.Mutex
+	size_reported  bool
+	reportedw      int
+	reportedh      int
 	in             int
 	lastfg         = attr_invalid
 	lastbg         = attr_invalid
@@ -70,13 +113,24 @@ var (
 	lasty          = coord_invalid
 	cursor_x       = cursor_hidden
 	cursor_y       = cursor_hidden
+	cursor_style   = CursorDefault
+	title_pushed   bool
+	palette_set    bool
+	default_set    bool
+	keypad_app     = true
+	linux_console  bool
+	alt_screen     = true
+	suspended      bool
+	lastlink       string
+	lastul         = ColorDefault
 	foreground     = ColorDefault
 	background     = ColorDefault
 	inbuf          = make([]byte, 0, 64)
 	outbuf         bytes.Buffer
 	sigwinch       = make(chan os.Signal, 1)
 	sigio          = make(chan os.Signal, 1)
-	quit           = make(chan int)
+	quit           chan struct{}
+	input_done     chan struct{}
 	input_comm     = make(chan input_event)
 	interrupt_comm = make(chan struct{})
 	intbuf         = make([]byte, 0, 16)
@@ -88,6 +142,96 @@ var (
 	}
 )
 
+// Sends the changes of the back buffer to the terminal, see Flush.
+func present() error {
+	if suspended {
+		return nil
+	}
+
+	// invalidate cursor position
+	lastx = coord_invalid
+	lasty = coord_invalid
+	changed_cells = 0
+
+	err := update_size_maybe()
+	if err != nil {
+		return err
+	}
+
+	for y := 0; y < front_buffer.height; y++ {
+		if !back_buffer.is_dirty(y) {
+			continue
+		}
+		back_buffer.dirty[y] = false
+		line_offset := y * front_buffer.width
+		for x := 0; x < front_buffer.width; {
+			cell_offset := line_offset + x
+			back := &back_buffer.cells[cell_offset]
+			front := &front_buffer.cells[cell_offset]
+			if back.Ch < ' ' {
+				back.Ch = ' '
+			}
+			w := RuneWidth(back.Ch)
+			if w == 0 {
+				w = 1
+			}
+			back_extra := &back_buffer.extras[cell_offset]
+			front_extra := &front_buffer.extras[cell_offset]
+			if !full_redraw && CellsEqual(*back, *front) && back_extra.equal(front_extra) {
+				x += w
+				continue
+			}
+			changed_cells++
+			*front = *back
+			*front_extra = *back_extra
+			send_attr(back.Fg, back.Bg)
+			send_underline_color(back_extra.ulcolor)
+			send_link(back_extra.link)
+
+			if w == 2 && x == front_buffer.width-1 {
+				// there's not enough space for 2-cells rune,
+				// let's just put a space in there
+				send_char(x, y, ' ', 1)
+			} else {
+				send_char(x, y, back.Ch, w)
+				for _, r := range back_extra.comb {
+					outbuf.WriteRune(r)
+				}
+				if w == 2 {
+					next := cell_offset + 1
+					front_buffer.cells[next] = Cell{
+						Ch: 0,
+						Fg: back.Fg,
+						Bg: back.Bg,
+					}
+					front_buffer.extras[next] = cell_extra{}
+				}
+			}
+			x += w
+		}
+	}
+	send_link("")
+	if !is_cursor_hidden(cursor_x, cursor_y) {
+		write_cursor(cursor_x, cursor_y)
+	}
+	return flush()
+}
+
+func set_cursor(x, y int) {
+	if is_cursor_hidden(cursor_x, cursor_y) && !is_cursor_hidden(x, y) {
+		outbuf.WriteString(funcs[t_show_cursor])
+	}
+
+	if !is_cursor_hidden(cursor_x, cursor_y) && is_cursor_hidden(x, y) {
+		outbuf.WriteString(funcs[t_hide_cursor])
+	}
+
+	cursor_x, cursor_y = x, y
+	if !is_cursor_hidden(cursor_x, cursor_y) {
+		write_cursor(cursor_x, cursor_y)
+	}
+}
+
 func write_cursor(x, y int) {
 	outbuf.WriteString("\033[")
 	outbuf.Write(strconv.AppendUint(intbuf, uint64(y+1), 10))
@@ -96,50 +240,94 @@ func write_cursor(x, y int) {
 	outbuf.WriteString("H")
 }
 
+func write_cursor_forward(n int) {
+	outbuf.WriteString("\033[")
+	outbuf.Write(strconv.AppendUint(intbuf, uint64(n), 10))
+	outbuf.WriteString("C")
+}
+
+// Writes the color in the "rgb:RR/GG/BB" form the OSC color sequences use.
+func write_osc_rgb(r, g, b uint8) {
+	const hex = "0123456789abcdef"
+	outbuf.WriteString("rgb:")
+	for i, c := range [3]uint8{r, g, b} {
+		if i != 0 {
+			outbuf.WriteByte('/')
+		}
+		outbuf.WriteByte(hex[c>>4])
+		outbuf.WriteByte(hex[c&0x0F])
+	}
+}
+
+func write_sgr_color(a Attribute) {
+	if a&attr_rgb != 0 {
+		r, g, b := AttributeToRGB(a)
+		outbuf.WriteString("2;")
+		outbuf.Write(strconv.AppendUint(intbuf, uint64(r), 10))
+		outbuf.WriteString(";")
+		outbuf.Write(strconv.AppendUint(intbuf, uint64(g), 10))
+		outbuf.WriteString(";")
+		outbuf.Write(strconv.AppendUint(intbuf, uint64(b), 10))
+	} else {
+		outbuf.WriteString("5;")
+		outbuf.Write(strconv.AppendUint(intbuf, uint64(a-1), 10))
+	}
+}
+
 func write_sgr_fg(a Attribute) {
 	switch output_mode {
-	case Output256, Output216, OutputGrayscale:
-		outbuf.WriteString("\033[38;5;")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(a-1), 10))
+	case Output256, Output216, OutputGrayscale, OutputRGB:
+		outbuf.WriteString("\033[38;")
+		write_sgr_color(a)
 		outbuf.WriteString("m")
 	default:
-		outbuf.WriteString("\033[3")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(a-1), 10))
+		outbuf.WriteString("\033[")
+		write_sgr_normal(a, 30)
 		outbuf.WriteString("m")
 	}
 }
 
 func write_sgr_bg(a Attribute) {
 	switch output_mode {
-	case Output256, Output216, OutputGrayscale:
-		outbuf.WriteString("\033[48;5;")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(a-1), 10))
+	case Output256, Output216, OutputGrayscale, OutputRGB:
+		outbuf.WriteString("\033[48;")
+		write_sgr_color(a)
 		outbuf.WriteString("m")
 	default:
-		outbuf.WriteString("\033[4")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(a-1), 10))
+		outbuf.WriteString("\033[")
+		write_sgr_normal(a, 40)
 		outbuf.WriteString("m")
 	}
 }
 
 func write_sgr(fg, bg Attribute) {
 	switch output_mode {
-	case Output256, Output216, OutputGrayscale:
-		outbuf.WriteString("\033[38;5;")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(fg-1), 10))
+	case Output256, Output216, OutputGrayscale, OutputRGB:
+		outbuf.WriteString("\033[38;")
+		write_sgr_color(fg)
 		outbuf.WriteString("m")
-		outbuf.WriteString("\033[48;5;")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(bg-1), 10))
+		outbuf.WriteString("\033[48;")
+		write_sgr_color(bg)
 		outbuf.WriteString("m")
 	default:
-		outbuf.WriteString("\033[3")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(fg-1), 10))
-		outbuf.WriteString(";4")
-		outbuf.Write(strconv.AppendUint(intbuf, uint64(bg-1), 10))
+		outbuf.WriteString("\033[")
+		write_sgr_normal(fg, 30)
+		outbuf.WriteString(";")
+		write_sgr_normal(bg, 40)
 		outbuf.WriteString("m")
 	}
 }
 
+// Writes the SGR parameter of an OutputNormal color, 'base' is 30 for the
+// foreground and 40 for the background. The bright colors are 60 more.
+func write_sgr_normal(a Attribute, base uint64) {
+	if a > ColorWhite {
+		base += 60
+		a -= 8
+	}
+	outbuf.Write(strconv.AppendUint(intbuf, base+uint64(a-1), 10))
+}
+
 type winsize struct {
 	rows    uint16
 	cols    uint16
@@ -147,6 +335,351 @@ type winsize struct {
 	ypixels uint16
 }
 
+// Opens the terminal for input and output. When there is no controlling
+// terminal (e.g. inside containers), falls back to duplicates of stdin and
+// stdout, provided both of them are terminals.
+func open_tty() error {
+	var err error
+
+	var tty *os.File
+
+	if runtime.GOOS == "openbsd" || runtime.GOOS == "freebsd" {
+		tty, err = os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err == nil {
+			out = tty
+			in = int(tty.Fd())
+			return nil
+		}
+	} else {
+		tty, err = os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+		if err == nil {
+			in, err = syscall.Open("/dev/tty", syscall.O_RDONLY, 0)
+			if err == nil {
+				out = tty
+				return nil
+			}
+			tty.Close()
+		}
+	}
+
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if err != syscall.ENOENT && err != syscall.ENXIO {
+		return fmt.Errorf("termbox: failed to open /dev/tty: %w", err)
+	}
+
+	var tios syscall_Termios
+	if tcgetattr(os.Stdin.Fd(), &tios) != nil ||
+		tcgetattr(os.Stdout.Fd(), &tios) != nil {
+		return fmt.Errorf("termbox: failed to open /dev/tty and stdin "+
+			"or stdout is not a terminal: %w", err)
+	}
+	return dup_files(os.Stdin.Fd(), os.Stdout.Fd(), "/dev/stdout")
+}
+
+// Sets 'in' and 'out' to duplicates of the given descriptors, so that closing
+// them later doesn't affect the originals.
+func dup_files(in_fd, out_fd uintptr, name string) error {
+	fd, err := syscall.Dup(int(out_fd))
+	if err != nil {
+		return fmt.Errorf("termbox: failed to duplicate the output descriptor: %w", err)
+	}
+	in, err = syscall.Dup(int(in_fd))
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("termbox: failed to duplicate the input descriptor: %w", err)
+	}
+	out = os.NewFile(uintptr(fd), name)
+	return nil
+}
+
+// Closes 'in' and 'out', see Close.
+func close_files() {
+	syscall.Close(in)
+	out.Close()
+	in, out = 0, nil
+}
+
+// Puts the terminal referred to by 'in' and 'out' into raw mode and starts
+// the input goroutine. On failure everything done so far is undone and 'in'
+// and 'out' are closed.
+func init_term(opts InitOptions) (err error) {
+	restore_fl := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		signal.Stop(sigwinch)
+		signal.Stop(sigio)
+		if restore_fl {
+			// the flags are shared with the files given to InitWithFiles
+			fcntl(in, syscall.F_SETFL, orig_fl)
+		}
+		close_files()
+	}()
+
+	err = setup_term()
+	if err != nil {
+		return fmt.Errorf("termbox: error while reading terminfo data: %w", err)
+	}
+	setup_caps_env()
+	output_mode = auto_output_mode()
+	if opts.OutputMode != OutputCurrent {
+		output_mode = opts.OutputMode
+	}
+	if opts.EscDelay > 0 {
+		esc_delay = opts.EscDelay
+	} else if opts.EscDelay < 0 {
+		esc_delay = 0
+	}
+	alt_screen = !opts.NoAltScreen
+
+	// nothing can be drawn into an empty buffer, e.g. in a detached session,
+	// unless the size is going to be set using SetSize
+	if w, h := term_size(); (w <= 0 || h <= 0) && !opts.NoSignals {
+		return fmt.Errorf("termbox: the terminal has no size (%dx%d)", w, h)
+	}
+
+	if !opts.NoSignals {
+		signal.Notify(sigwinch, syscall.SIGWINCH)
+	}
+	signal.Notify(sigio, syscall.SIGIO)
+
+	orig_fl, err = fcntl(in, syscall.F_GETFL, 0)
+	if err != nil {
+		return fmt.Errorf("termbox: failed to get the input file flags: %w", err)
+	}
+	restore_fl = true
+	err = tcgetattr(out.Fd(), &orig_tios)
+	if err != nil {
+		return fmt.Errorf("termbox: failed to get terminal attributes: %w", err)
+	}
+	err = set_raw_mode()
+	if err != nil {
+		return err
+	}
+
+	if alt_screen {
+		out.WriteString(funcs[t_enter_ca])
+	}
+	out.WriteString(funcs[t_enter_keypad])
+	out.WriteString(funcs[t_hide_cursor])
+	out.WriteString(funcs[t_clear_screen])
+	set_input_mode(opts.InputMode)
+	flush()
+
+	termw, termh = term_size()
+	back_buffer.init(termw, termh)
+	front_buffer.init(termw, termh)
+	back_buffer.clear()
+	front_buffer.clear()
+
+	start_input()
+
+	IsInit = true
+	return nil
+}
+
+// Switches the terminal to the input mode, see SetInputMode. The sequences
+// are queued in 'outbuf'.
+func set_input_mode(mode InputMode) {
+	if mode&(InputEsc|InputAlt) == 0 {
+		mode |= InputEsc
+	}
+	if mode&(InputEsc|InputAlt) == InputEsc|InputAlt {
+		mode &^= InputAlt
+	}
+	if mode&InputMouse == 0 {
+		mode &^= InputMouseMotion
+	}
+	if suspended {
+		// reenter_term enables the mode on Resume
+		input_mode = mode
+		return
+	}
+	if input_mode&InputMouseMotion != 0 && mode&InputMouseMotion == 0 {
+		outbuf.WriteString(ti_mouse_motion_leave)
+	}
+	if mode&InputMouse != 0 {
+		outbuf.WriteString(funcs[t_enter_mouse])
+	} else {
+		outbuf.WriteString(funcs[t_exit_mouse])
+	}
+	if mode&InputMouseMotion != 0 && funcs[t_enter_mouse] != "" {
+		outbuf.WriteString(ti_mouse_motion_enter)
+	}
+	if mode&InputPaste != 0 {
+		outbuf.WriteString(ti_paste_enter)
+	} else if input_mode&InputPaste != 0 {
+		outbuf.WriteString(ti_paste_leave)
+	}
+	if mode&InputFocus != 0 {
+		outbuf.WriteString(ti_focus_enter)
+	} else if input_mode&InputFocus != 0 {
+		outbuf.WriteString(ti_focus_leave)
+	}
+
+	input_mode = mode
+}
+
+// Switches 'in' to asynchronous non-blocking reads and the terminal to raw
+// mode, Close and Suspend restore 'orig_fl' and 'orig_tios'.
+func set_raw_mode() error {
+	_, err := fcntl(in, syscall.F_SETFL, syscall.O_ASYNC|syscall.O_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("termbox: failed to set the input file flags: %w", err)
+	}
+	_, err = fcntl(in, syscall.F_SETOWN, syscall.Getpid())
+	if runtime.GOOS != "darwin" && err != nil {
+		return fmt.Errorf("termbox: failed to set the owner of the input: %w", err)
+	}
+
+	tios := orig_tios
+	tios.Iflag &^= syscall_IGNBRK | syscall_BRKINT | syscall_PARMRK |
+		syscall_ISTRIP | syscall_INLCR | syscall_IGNCR |
+		syscall_ICRNL | syscall_IXON
+	tios.Lflag &^= syscall_ECHO | syscall_ECHONL | syscall_ICANON |
+		syscall_ISIG | syscall_IEXTEN
+	tios.Cflag &^= syscall_CSIZE | syscall_PARENB
+	tios.Cflag |= syscall_CS8
+	tios.Cc[syscall_VMIN] = 1
+	tios.Cc[syscall_VTIME] = 0
+
+	err = tcsetattr(out.Fd(), &tios)
+	if err != nil {
+		return fmt.Errorf("termbox: failed to set terminal attributes: %w", err)
+	}
+	return nil
+}
+
+func start_input() {
+	quit = make(chan struct{})
+	input_done = make(chan struct{})
+	go input_event_producer()
+}
+
+func stop_input() {
+	close(quit)
+	<-input_done
+}
+
+// Gives the terminal back in the state termbox got it in, except for the
+// title, see Close and Suspend. The input goroutine is stopped.
+func leave_term() {
+	if !headless {
+		stop_input()
+	}
+
+	out.WriteString(funcs[t_show_cursor])
+	out.WriteString(funcs[t_sgr0])
+	if alt_screen {
+		out.WriteString(funcs[t_clear_screen])
+		out.WriteString(funcs[t_exit_ca])
+	} else {
+		// leave the contents of the screen, the shell continues below
+		write_cursor(0, termh-1)
+		outbuf.WriteString("\r\n")
+		flush()
+	}
+	out.WriteString(funcs[t_exit_keypad])
+	if input_mode&InputMouseMotion != 0 {
+		out.WriteString(ti_mouse_motion_leave)
+	}
+	out.WriteString(funcs[t_exit_mouse])
+	if input_mode&InputPaste != 0 {
+		out.WriteString(ti_paste_leave)
+	}
+	if input_mode&InputFocus != 0 {
+		out.WriteString(ti_focus_leave)
+	}
+	if cursor_style != CursorDefault {
+		out.WriteString("\033[0 q")
+	}
+
+	if !headless {
+		tcsetattr(out.Fd(), &orig_tios)
+		fcntl(in, syscall.F_SETFL, orig_fl)
+	}
+}
+
+// The opposite of leave_term, see Resume. The screen has to be redrawn
+// afterwards.
+func reenter_term() error {
+	if !headless {
+		err := set_raw_mode()
+		if err != nil {
+			return err
+		}
+		start_input()
+	}
+
+	if alt_screen {
+		out.WriteString(funcs[t_enter_ca])
+	}
+	if keypad_app {
+		out.WriteString(funcs[t_enter_keypad])
+	}
+	if is_cursor_hidden(cursor_x, cursor_y) {
+		out.WriteString(funcs[t_hide_cursor])
+	}
+	if input_mode&InputMouse != 0 {
+		out.WriteString(funcs[t_enter_mouse])
+	}
+	if input_mode&InputMouseMotion != 0 && funcs[t_enter_mouse] != "" {
+		out.WriteString(ti_mouse_motion_enter)
+	}
+	if input_mode&InputPaste != 0 {
+		out.WriteString(ti_paste_enter)
+	}
+	if input_mode&InputFocus != 0 {
+		out.WriteString(ti_focus_enter)
+	}
+	if cursor_style != CursorDefault {
+		write_cursor_style(cursor_style)
+	}
+
+	// the attributes were reset by leave_term
+	lastfg, lastbg = attr_invalid, attr_invalid
+	return nil
+}
+
+// Initializes the headless mode, see InitWithWriter.
+func init_headless(w io.Writer, width, height int) error {
+	if width <= 0 || height <= 0 {
+		return errors.New("termbox: invalid size")
+	}
+
+	keys = xterm_keys
+	funcs = xterm_funcs
+	caps = TerminalCapabilities{Colors: 256, Mouse: true}
+	out = writer_output{w}
+	headless = true
+	headlessw, headlessh = width, height
+
+	out.WriteString(funcs[t_enter_ca])
+	out.WriteString(funcs[t_enter_keypad])
+	out.WriteString(funcs[t_hide_cursor])
+	out.WriteString(funcs[t_clear_screen])
+
+	termw, termh = term_size()
+	back_buffer.init(termw, termh)
+	front_buffer.init(termw, termh)
+	back_buffer.clear()
+	front_buffer.clear()
+
+	IsInit = true
+	return nil
+}
+
+// Returns the size of the terminal, or the fixed size in headless mode.
+func term_size() (int, int) {
+	if headless {
+		return headlessw, headlessh
+	}
+	return get_term_size(out.Fd())
+}
+
 func get_term_size(fd uintptr) (int, int) {
 	var sz winsize
 	_, _, _ = syscall.Syscall(syscall.SYS_IOCTL,
@@ -154,54 +687,90 @@ func get_term_size(fd uintptr) (int, int) {
 	return int(sz.cols), int(sz.rows)
 }
 
-func send_attr(fg, bg Attribute) {
-	if fg == lastfg && bg == lastbg {
-		return
+// Returns the color of the attribute as it's sent to the terminal in the
+// current output mode.
+func output_color(a Attribute) Attribute {
+	if output_mode != OutputRGB && a&attr_rgb != 0 {
+		// RGB colors are not available, fall back to the default one
+		return ColorDefault
 	}
 
-	outbuf.WriteString(funcs[t_sgr0])
-
-	var fgcol, bgcol Attribute
+	var col Attribute
 
 	switch output_mode {
+	case OutputRGB:
+		col = a & 0x1FF
+		if a&attr_rgb != 0 {
+			col = a & attr_color_mask
+		}
 	case Output256:
-		fgcol = fg & 0x1FF
-		bgcol = bg & 0x1FF
+		col = a & 0x1FF
 	case Output216:
-		fgcol = fg & 0xFF
-		bgcol = bg & 0xFF
-		if fgcol > 216 {
-			fgcol = ColorDefault
+		col = a & attr_color_mask
+		if col > 216 {
+			col = 216
 		}
-		if bgcol > 216 {
-			bgcol = ColorDefault
+		if col != ColorDefault {
+			col += 0x10
 		}
-		if fgcol != ColorDefault {
-			fgcol += 0x10
+	case OutputGrayscale:
+		col = a & attr_color_mask
+		if col > 26 {
+			col = 26
 		}
-		if bgcol != ColorDefault {
-			bgcol += 0x10
+		if col != ColorDefault {
+			col = grayscale[col]
 		}
-	case OutputGrayscale:
-		fgcol = fg & 0x1F
-		bgcol = bg & 0x1F
-		if fgcol > 26 {
-			fgcol = ColorDefault
+	default:
+		col = a & 0x1F
+		if col > ColorLightGray {
+			col = ColorDefault
 		}
-		if bgcol > 26 {
-			bgcol = ColorDefault
+		if linux_console && a&AttrBold != 0 &&
+			col >= ColorBlack && col <= ColorWhite {
+			// the console draws bold as the bright color, ask for
+			// it directly, see send_attr
+			col += 8
 		}
-		if fgcol != ColorDefault {
-			fgcol = grayscale[fgcol]
+	}
+	return col
+}
+
+func send_attr(fg, bg Attribute) {
+	if fg == lastfg && bg == lastbg {
+		return
+	}
+
+	fgcol, bgcol := output_color(fg), output_color(bg)
+	lastfgcol, lastbgcol := output_color(lastfg), output_color(lastbg)
+	if lastfg != attr_invalid &&
+		fg&^attr_color_mask == lastfg&^attr_color_mask &&
+		bg&^attr_color_mask == lastbg&^attr_color_mask &&
+		sends_bold(fg, fgcol) == sends_bold(lastfg, lastfgcol) {
+		// only the colors differ, there's no need to reset the other
+		// attributes, send just the color which changed
+		lastfg, lastbg = fg, bg
+		if fgcol != lastfgcol {
+			if fgcol != ColorDefault {
+				write_sgr_fg(fgcol)
+			} else {
+				outbuf.WriteString("\033[39m")
+			}
 		}
-		if bgcol != ColorDefault {
-			bgcol = grayscale[bgcol]
+		if bgcol != lastbgcol {
+			if bgcol != ColorDefault {
+				write_sgr_bg(bgcol)
+			} else {
+				outbuf.WriteString("\033[49m")
+			}
 		}
-	default:
-		fgcol = fg & 0x0F
-		bgcol = bg & 0x0F
+		return
 	}
 
+	outbuf.WriteString(funcs[t_sgr0])
+	lastfg, lastbg = fg, bg
+	lastul = ColorDefault
+
 	if fgcol != ColorDefault {
 		if bgcol != ColorDefault {
 			write_sgr(fgcol, bgcol)
@@ -212,38 +781,182 @@ func send_attr(fg, bg Attribute) {
 		write_sgr_bg(bgcol)
 	}
 
-	if fg&AttrBold != 0 {
+	if sends_bold(fg, fgcol) {
 		outbuf.WriteString(funcs[t_bold])
 	}
-	if bg&AttrBold != 0 {
+	if fg&AttrBlink|bg&AttrBold != 0 {
 		outbuf.WriteString(funcs[t_blink])
 	}
-	if fg&AttrUnderline != 0 {
+	if fg&AttrDim != 0 {
+		outbuf.WriteString(funcs[t_dim])
+	}
+	if fg&AttrItalic != 0 {
+		outbuf.WriteString(funcs[t_italic])
+	}
+	switch {
+	case fg&AttrCurlyUnderline != 0 && caps.Undercurl:
+		outbuf.WriteString("\033[4:3m")
+	case fg&AttrDoubleUnderline != 0 && caps.Undercurl:
+		outbuf.WriteString("\033[4:2m")
+	case fg&(AttrUnderline|AttrDoubleUnderline|AttrCurlyUnderline) != 0:
 		outbuf.WriteString(funcs[t_underline])
 	}
+	if fg&AttrStrikethrough != 0 {
+		outbuf.WriteString("\033[9m")
+	}
 	if fg&AttrReverse|bg&AttrReverse != 0 {
 		outbuf.WriteString(funcs[t_reverse])
 	}
+}
 
-	lastfg, lastbg = fg, bg
+// Returns true if send_attr turns bold on for 'fg' drawn with 'fgcol' (see
+// output_color). On the linux console the bright color is the bold one
+// already, so the color changes along with the bold state there.
+func sends_bold(fg, fgcol Attribute) bool {
+	bright := linux_console && output_mode == OutputNormal && fgcol > ColorWhite
+	return fg&AttrBold != 0 && !bright
+}
+
+// Sets the color of the underlines, SGR 0 sent by send_attr resets it to
+// ColorDefault.
+func send_underline_color(color Attribute) {
+	col := output_color(color)
+	if col == lastul {
+		return
+	}
+	lastul = col
+	if col == ColorDefault {
+		outbuf.WriteString("\033[59m")
+		return
+	}
+	outbuf.WriteString("\033[58;")
+	write_sgr_color(col)
+	outbuf.WriteString("m")
 }
 
-func send_char(x, y int, ch rune) {
+func write_cursor_style(style CursorStyle) {
+	outbuf.WriteString("\033[")
+	outbuf.Write(strconv.AppendUint(intbuf, uint64(style), 10))
+	outbuf.WriteString(" q")
+}
+
+// Starts the hyperlink the following characters belong to, an empty 'url'
+// ends the current one.
+func send_link(url string) {
+	if url == lastlink {
+		return
+	}
+	lastlink = url
+	outbuf.WriteString("\033]8;;")
+	for _, r := range url {
+		if r < ' ' || r >= 0x7f && r < 0xa0 {
+			continue
+		}
+		outbuf.WriteRune(r)
+	}
+	outbuf.WriteString("\007")
+}
+
+// Sends the rune occupying 'w' cells at 'x', 'y'. The cursor is moved there
+// only if it's not there already after the previous rune, 'lastx' is the last
+// cell the previous rune occupied.
+func send_char(x, y int, ch rune, w int) {
 	var buf [8]byte
 	n := utf8.EncodeRune(buf[:], ch)
-	if x-1 != lastx || y != lasty {
+	switch {
+	case y != lasty || lastx == coord_invalid || x <= lastx:
 		write_cursor(x, y)
+	case x-1 != lastx:
+		// a gap of unchanged cells on the same line, CUF is shorter
+		write_cursor_forward(x - lastx - 1)
 	}
-	lastx, lasty = x, y
+	lastx, lasty = x+w-1, y
 	outbuf.Write(buf[:n])
 }
 
+// Returns true if there's output waiting for the next Flush, see Dirty.
+func pending_output() bool {
+	return outbuf.Len() != 0
+}
+
+// Writes the whole back buffer to 'w' as text with escape sequences for the
+// attributes, one line per row, see RenderTo. The output is produced in
+// 'outbuf' after the pending output, the state of the terminal's output is
+// saved and restored around it.
+func render_to(w io.Writer) error {
+	fg, bg, ul, link := lastfg, lastbg, lastul, lastlink
+	n := outbuf.Len()
+
+	lastfg, lastbg, lastlink = attr_invalid, attr_invalid, ""
+	for y := 0; y < back_buffer.height; y++ {
+		line_offset := y * back_buffer.width
+		for x := 0; x < back_buffer.width; {
+			cell := back_buffer.cells[line_offset+x]
+			extra := &back_buffer.extras[line_offset+x]
+			rw := max_int(RuneWidth(cell.Ch), 1)
+			if cell.Ch < ' ' || rw == 2 && x == back_buffer.width-1 {
+				cell.Ch, rw = ' ', 1
+			}
+			send_attr(cell.Fg, cell.Bg)
+			send_underline_color(extra.ulcolor)
+			send_link(extra.link)
+			outbuf.WriteRune(cell.Ch)
+			for _, r := range extra.comb {
+				outbuf.WriteRune(r)
+			}
+			x += rw
+		}
+		// reset the attributes, so that the background doesn't extend
+		// to the end of the line
+		send_link("")
+		outbuf.WriteString(funcs[t_sgr0])
+		outbuf.WriteString("\n")
+		lastfg, lastbg = attr_invalid, attr_invalid
+	}
+
+	_, err := w.Write(outbuf.Bytes()[n:])
+	outbuf.Truncate(n)
+	lastfg, lastbg, lastul, lastlink = fg, bg, ul, link
+	return err
+}
+
 func flush() error {
 	_, err := io.Copy(out, &outbuf)
 	outbuf.Reset()
 	return err
 }
 
+// Sends a terminfo string with delays in it, e.g. "\033[?5h$<100/>\033[?5l".
+// Each "$<N>" delay flushes the output and sleeps for N milliseconds, the flags
+// and fractions it may have are ignored.
+func send_padded(s string) error {
+	for {
+		i := strings.Index(s, "$<")
+		if i == -1 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j == -1 {
+			break
+		}
+		outbuf.WriteString(s[:i])
+		ms := 0
+		for _, c := range s[i+2 : i+j] {
+			if c < '0' || c > '9' {
+				break
+			}
+			ms = ms*10 + int(c-'0')
+		}
+		s = s[i+j+1:]
+		if err := flush(); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+	}
+	outbuf.WriteString(s)
+	return flush()
+}
+
 func send_clear() error {
 	send_attr(foreground, background)
 	outbuf.WriteString(funcs[t_clear_screen])
@@ -262,10 +975,35 @@ func send_clear() error {
 	return flush()
 }
 
+// Queries the terminal size for EventResize and remembers it, from then on
+// update_size_maybe resizes the buffers to the reported sizes only. This way
+// the size an application got with EventResize, Size() and the buffers always
+// agree, even if the terminal is resized again in the middle of a frame.
+func report_resize() (int, int) {
+	w, h := term_size()
+	set_reported_size(w, h)
+	return w, h
+}
+
+// Makes update_size_maybe resize the buffers to the given size, see
+// report_resize and SetSize.
+func set_reported_size(w, h int) {
+	size_lock.Lock()
+	size_reported = true
+	reportedw, reportedh = w, h
+	size_lock.Unlock()
+}
+
 func update_size_maybe() error {
-	w, h := get_term_size(out.Fd())
+	size_lock.Lock()
+	reported, w, h := size_reported, reportedw, reportedh
+	size_lock.Unlock()
+	if !reported {
+		w, h = term_size()
+	}
 	if w != termw || h != termh {
 		termw, termh = w, h
+		resize_pending = true
 		back_buffer.resize(termw, termh)
 		front_buffer.resize(termw, termh)
 		front_buffer.clear()
@@ -292,32 +1030,48 @@ func tcgetattr(fd uintptr, termios *syscall_Termios) error {
 	return nil
 }
 
+// Decodes the button number of a mouse report. 'b' is zero-based and may
+// contain modifier bits (4, 8, 16) and the motion bit (32). Wheel events have
+// the 64 bit set, buttons 8-11 have the 128 bit set.
+func decode_mouse_button(b int64) (Key, bool) {
+	switch {
+	case b&128 != 0:
+		// extra buttons, not supported
+		return 0, false
+	case b&64 != 0:
+		switch b & 3 {
+		case 0:
+			return MouseWheelUp, true
+		case 1:
+			return MouseWheelDown, true
+		}
+		// horizontal scrolling (buttons 6 and 7), not supported
+		return 0, false
+	}
+
+	switch b & 3 {
+	case 0:
+		return MouseLeft, true
+	case 1:
+		return MouseMiddle, true
+	case 2:
+		return MouseRight, true
+	}
+	return MouseRelease, true
+}
+
 func parse_mouse_event(event *Event, buf string) (int, bool) {
 	if strings.HasPrefix(buf, "\033[M") && len(buf) >= 6 {
 		// X10 mouse encoding, the simplest one
 		// \033 [ M Cb Cx Cy
 		b := buf[3] - 32
-		switch b & 3 {
-		case 0:
-			if b&64 != 0 {
-				event.Key = MouseWheelUp
-			} else {
-				event.Key = MouseLeft
-			}
-		case 1:
-			if b&64 != 0 {
-				event.Key = MouseWheelDown
-			} else {
-				event.Key = MouseMiddle
-			}
-		case 2:
-			event.Key = MouseRight
-		case 3:
-			event.Key = MouseRelease
-		default:
+		key, ok := decode_mouse_button(int64(b))
+		if !ok {
 			return 6, false
 		}
+		event.Key = key
 		event.Type = EventMouse // KeyEvent by default
+		event.Mod |= decode_mouse_modifier(int64(b))
 		if b&32 != 0 {
 			event.Mod |= ModMotion
 		}
@@ -331,9 +1085,10 @@ func parse_mouse_event(event *Event, buf string) (int, bool) {
 		// xterm: \033 [ < Cb ; Cx ; Cy (M or m)
 		// urxvt: \033 [ Cb ; Cx ; Cy M
 
-		// find the first M or m, that's where we stop
-		mi := strings.IndexAny(buf, "Mm")
-		if mi == -1 {
+		// find the final byte of the sequence, that's where we stop, it has
+		// to be M or m, otherwise it's not a mouse sequence
+		mi := csi_final_index(buf)
+		if mi == -1 || buf[mi] != 'M' && buf[mi] != 'm' {
 			return 0, false
 		}
 
@@ -377,32 +1132,18 @@ func parse_mouse_event(event *Event, buf string) (int, bool) {
 		if isU {
 			n1 -= 32
 		}
-		switch n1 & 3 {
-		case 0:
-			if n1&64 != 0 {
-				event.Key = MouseWheelUp
-			} else {
-				event.Key = MouseLeft
-			}
-		case 1:
-			if n1&64 != 0 {
-				event.Key = MouseWheelDown
-			} else {
-				event.Key = MouseMiddle
-			}
-		case 2:
-			event.Key = MouseRight
-		case 3:
-			event.Key = MouseRelease
-		default:
+		key, ok := decode_mouse_button(n1)
+		if !ok {
 			return mi + 1, false
 		}
+		event.Key = key
 		if !isM {
 			// on xterm mouse release is signaled by lowercase m
 			event.Key = MouseRelease
 		}
 
 		event.Type = EventMouse // KeyEvent by default
+		event.Mod |= decode_mouse_modifier(n1)
 		if n1&32 != 0 {
 			event.Mod |= ModMotion
 		}
@@ -415,16 +1156,181 @@ func parse_mouse_event(event *Event, buf string) (int, bool) {
 	return 0, false
 }
 
+// Returns the index of the final byte of the CSI sequence at the beginning of
+// 'buf' or -1 if the sequence is not terminated. Parameter and intermediate
+// bytes are in the 0x20-0x3F range, the final byte is in the 0x40-0x7E range.
+func csi_final_index(buf string) int {
+	for i := 2; i < len(buf); i++ {
+		c := buf[i]
+		switch {
+		case c >= 0x40 && c <= 0x7E:
+			return i
+		case c < 0x20 || c > 0x3F:
+			return -1
+		}
+	}
+	return -1
+}
+
+// Converts the modifier parameter of a CSI sequence (1 + a bit mask) into
+// Mod* constants.
+func decode_modifier(m int64) Modifier {
+	var mod Modifier
+	m--
+	if m&1 != 0 {
+		mod |= ModShift
+	}
+	if m&(2|8) != 0 {
+		// meta is reported as alt
+		mod |= ModAlt
+	}
+	if m&4 != 0 {
+		mod |= ModCtrl
+	}
+	return mod
+}
+
+// Converts the modifier bits of a mouse report into Mod* constants.
+func decode_mouse_modifier(b int64) Modifier {
+	var mod Modifier
+	if b&4 != 0 {
+		mod |= ModShift
+	}
+	if b&8 != 0 {
+		mod |= ModAlt
+	}
+	if b&16 != 0 {
+		mod |= ModCtrl
+	}
+	return mod
+}
+
+// Parses keys with modifiers in the form used by xterm and others:
+// "\033[1;<mod><letter>" for cursor keys, Home, End and F1-F4, and
+// "\033[<num>;<mod>~" for the rest of the editing and function keys, e.g.
+// "\033[1;5C" is Ctrl+Right and "\033[3;2~" is Shift+Delete.
+func parse_modified_key(event *Event, buf string) (int, bool) {
+	if !strings.HasPrefix(buf, "\033[") {
+		return 0, false
+	}
+	end := csi_final_index(buf)
+	if end == -1 {
+		return 0, false
+	}
+	semi := strings.IndexByte(buf[:end], ';')
+	if semi == -1 {
+		return 0, false
+	}
+	num, err := strconv.ParseInt(buf[2:semi], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	m, err := strconv.ParseInt(buf[semi+1:end], 10, 32)
+	if err != nil || m < 1 {
+		return 0, false
+	}
+
+	var key Key
+	if buf[end] == '~' {
+		key = tilde_keys[num]
+	} else if num == 1 {
+		key = letter_keys[buf[end]]
+	}
+	if key == 0 {
+		return 0, false
+	}
+	event.Ch = 0
+	event.Key = key
+	event.Mod |= decode_modifier(m)
+	return end + 1, true
+}
+
+// Parses the keys which terminfo doesn't describe: cursor keys in the normal
+// cursor mode ("\033[A") when terminfo has the application mode ones
+// ("\033OA") or vice versa, and the numeric keypad in the application keypad
+// mode ("\033Op" is '0' etc.), see SetKeypadMode.
+func parse_keypad_key(event *Event, buf string) (int, bool) {
+	if len(buf) < 3 || buf[0] != '\033' || buf[1] != '[' && buf[1] != 'O' {
+		return 0, false
+	}
+	if key, ok := letter_keys[buf[2]]; ok {
+		event.Ch = 0
+		event.Key = key
+		return 3, true
+	}
+	if buf[1] != 'O' {
+		return 0, false
+	}
+	if buf[2] == 'M' {
+		event.Ch = 0
+		event.Key = KeyEnter
+		return 3, true
+	}
+	if ch, ok := keypad_runes[buf[2]]; ok {
+		event.Ch = ch
+		event.Key = 0
+		return 3, true
+	}
+	return 0, false
+}
+
+// Runes of the application keypad mode "\033O<letter>" sequences, by the
+// letter.
+var keypad_runes = map[byte]rune{
+	'p': '0', 'q': '1', 'r': '2', 's': '3', 't': '4', 'u': '5', 'v': '6',
+	'w': '7', 'x': '8', 'y': '9', 'j': '*', 'k': '+', 'l': ',', 'm': '-',
+	'n': '.', 'o': '/', 'X': '=',
+}
+
+// Keys of "\033[<num>~" sequences, by the number.
+var tilde_keys = map[int64]Key{
+	1: KeyHome, 2: KeyInsert, 3: KeyDelete, 4: KeyEnd, 5: KeyPgup,
+	6: KeyPgdn, 7: KeyHome, 8: KeyEnd, 11: KeyF1, 12: KeyF2, 13: KeyF3,
+	14: KeyF4, 15: KeyF5, 17: KeyF6, 18: KeyF7, 19: KeyF8, 20: KeyF9,
+	21: KeyF10, 23: KeyF11, 24: KeyF12, 25: KeyF13, 26: KeyF14, 28: KeyF15,
+	29: KeyF16, 31: KeyF17, 32: KeyF18, 33: KeyF19, 34: KeyF20,
+}
+
+// Keys of "\033[1;<mod><letter>" sequences, by the letter.
+var letter_keys = map[byte]Key{
+	'A': KeyArrowUp, 'B': KeyArrowDown, 'C': KeyArrowRight,
+	'D': KeyArrowLeft, 'H': KeyHome, 'F': KeyEnd, 'P': KeyF1, 'Q': KeyF2,
+	'R': KeyF3, 'S': KeyF4,
+}
+
+// Returns the key of the 'i'th entry in 'keys'. The entries go in the order of
+// the Key* constants, KeyF13..KeyF24 come after the mouse ones though.
+func key_at(i int) Key {
+	if n := int(0xFFFF - key_min); i >= n {
+		return KeyF13 - Key(i-n)
+	}
+	return Key(0xFFFF - i)
+}
+
 func parse_escape_sequence(event *Event, buf []byte) (int, bool) {
 	bufstr := string(buf)
 	for i, key := range keys {
+		if key == "" {
+			// the key is not supported by the terminal
+			continue
+		}
 		if strings.HasPrefix(bufstr, key) {
 			event.Ch = 0
-			event.Key = Key(0xFFFF - i)
+			event.Key = key_at(i)
 			return len(key), true
 		}
 	}
 
+	// keys with modifiers
+	if n, ok := parse_modified_key(event, bufstr); ok {
+		return n, true
+	}
+
+	// the other cursor key and keypad forms
+	if n, ok := parse_keypad_key(event, bufstr); ok {
+		return n, true
+	}
+
 	// if none of the keys match, let's try mouse sequences
 	return parse_mouse_event(event, bufstr)
 }
@@ -454,6 +1360,30 @@ func extract_event(inbuf []byte, event *Event, allow_esc_wait bool) extract_even
 		return event_not_extracted
 	}
 
+	if input_mode&InputPaste != 0 && bytes.HasPrefix(inbuf, []byte(ti_paste_begin)) {
+		// bracketed paste, wait until the whole text is in the buffer
+		end := bytes.Index(inbuf, []byte(ti_paste_end))
+		if end == -1 {
+			event.N = 0
+			return event_not_extracted
+		}
+		event.Type = EventPaste
+		event.Paste = string(inbuf[len(ti_paste_begin):end])
+		event.N = end + len(ti_paste_end)
+		return event_extracted
+	}
+
+	// focus reports, always recognized, so that they are never mistaken for
+	// ESC followed by a key
+	for _, seq := range [...]string{ti_focus_in, ti_focus_out} {
+		if bytes.HasPrefix(inbuf, []byte(seq)) {
+			event.Type = EventFocus
+			event.Focus = seq == ti_focus_in
+			event.N = len(seq)
+			return event_extracted
+		}
+	}
+
 	if inbuf[0] == '\033' {
 		// possible escape sequence
 		if n, ok := parse_escape_sequence(event, inbuf); n != 0 {
@@ -466,11 +1396,22 @@ func extract_event(inbuf []byte, event *Event, allow_esc_wait bool) extract_even
 		}
 
 		// possible partially read escape sequence; trigger a wait if appropriate
-		if enable_wait_for_escape_sequence() && allow_esc_wait {
+		if allow_esc_wait && (esc_delay > 0 && len(inbuf) == 1 || is_partial_sequence(inbuf)) {
 			event.N = 0
 			return esc_wait
 		}
 
+		// a complete CSI sequence termbox doesn't know, report it as is
+		// rather than as ESC followed by keys
+		if len(inbuf) > 2 && inbuf[1] == '[' {
+			if end := csi_final_index(string(inbuf)); end != -1 {
+				event.Type = EventRaw
+				event.Raw = append([]byte(nil), inbuf[:end+1]...)
+				event.N = end + 1
+				return event_extracted
+			}
+		}
+
 		// it's not escape sequence, then it's Alt or Esc, check input_mode
 		switch {
 		case input_mode&InputEsc != 0:
@@ -482,6 +1423,11 @@ func extract_event(inbuf []byte, event *Event, allow_esc_wait bool) extract_even
 			return event_extracted
 		case input_mode&InputAlt != 0:
 			// if we're in alt mode, set Alt modifier to event and redo parsing
+			if allow_esc_wait && len(inbuf) > 1 && !utf8.FullRune(inbuf[1:]) {
+				// wait for the rest of the rune after ESC first
+				event.N = 0
+				return esc_wait
+			}
 			event.Mod = ModAlt
 			status := extract_event(inbuf[1:], event, false)
 			if status == event_extracted {
@@ -507,17 +1453,365 @@ func extract_event(inbuf []byte, event *Event, allow_esc_wait bool) extract_even
 		return event_extracted
 	}
 
-	// the only possible option is utf8 rune
-	if r, n := utf8.DecodeRune(inbuf); r != utf8.RuneError {
+	// the only possible option is utf8 rune, wait for the rest of it if the
+	// buffer ends in the middle, poll_event gives up on it after the escape
+	// delay (see esc_wait_delay)
+	if !utf8.FullRune(inbuf) {
+		if allow_esc_wait {
+			event.N = 0
+			return esc_wait
+		}
+		if input_mode&InputAlt == 0 {
+			event.N = 0
+			return event_not_extracted
+		}
+		// in alt mode the rest didn't arrive in time, so it's not a rune
+		// but a key with the 8th bit set, see below
+	}
+	if r, n := utf8.DecodeRune(inbuf); r != utf8.RuneError || n > 1 {
 		event.Ch = r
 		event.Key = 0
 		event.N = n
 		return event_extracted
 	}
 
+	// not UTF-8, in alt mode it may be a key with the 8th bit set by the
+	// terminal's meta key (e.g. xterm's eightBitInput)
+	if input_mode&InputAlt != 0 && inbuf[0] >= 0x80 {
+		c := inbuf[0] &^ 0x80
+		event.Ch, event.Key = rune(c), 0
+		if Key(c) <= KeySpace || Key(c) == KeyBackspace2 {
+			event.Ch, event.Key = 0, Key(c)
+		}
+		event.Mod |= ModAlt
+		event.N = 1
+		return event_extracted
+	}
+
+	// invalid byte, skip it
+	event.N = 1
 	return event_not_extracted
 }
 
+// Returns true if 'buf' (starting with ESC) ends in the middle of a sequence
+// termbox knows, more input is needed to parse it then. A lone ESC is not
+// considered partial, see SetEscDelay.
+func is_partial_sequence(buf []byte) bool {
+	if len(buf) < 2 {
+		return false
+	}
+	bufstr := string(buf)
+	for _, key := range keys {
+		if len(key) > len(bufstr) && strings.HasPrefix(key, bufstr) {
+			return true
+		}
+	}
+	if input_mode&InputPaste != 0 && len(ti_paste_begin) > len(bufstr) &&
+		strings.HasPrefix(ti_paste_begin, bufstr) {
+		return true
+	}
+	if buf[1] != '[' {
+		return false
+	}
+	if len(buf) > 2 && buf[2] == 'M' {
+		// X10 mouse encoding has 3 bytes after "\033[M"
+		return len(buf) < 6
+	}
+	// CSI sequence without the final byte yet
+	return csi_final_index(bufstr) == -1 && bytes.IndexFunc(buf[2:], func(r rune) bool {
+		return r < 0x20 || r > 0x3F
+	}) == -1
+}
+
+// Waits for an event and returns it. Returns false if 'done' was closed before
+// an event arrived, partially read input stays in the input buffer then.
+func poll_event(done <-chan struct{}) (Event, bool) {
+	var event Event
+	var esc_wait_timer *time.Timer
+	var esc_timeout <-chan time.Time
+	var esc_wait_for time.Duration
+
+	// extracts an event from the input buffer, skipping the bytes which can't
+	// be parsed, the lock keeps SetInputMode and SetEscDelay from changing
+	// the settings meanwhile
+	extract := func(allow_esc_wait bool) extract_event_res {
+		api_lock.Lock()
+		defer api_lock.Unlock()
+		esc_wait_for = esc_wait_delay()
+		for {
+			event = Event{Type: EventKey}
+			status := extract_event(inbuf, &event, allow_esc_wait)
+			if event.N != 0 {
+				copy(inbuf, inbuf[event.N:])
+				inbuf = inbuf[:len(inbuf)-event.N]
+			}
+			if status == event_extracted && input_mode&InputCoalesce != 0 {
+				coalesce_key_repeats(&event)
+			}
+			if status != event_not_extracted || event.N == 0 {
+				return status
+			}
+		}
+	}
+
+	if ev, ok := pop_injected(); ok {
+		return ev, true
+	}
+
+	// try to extract event from input buffer, return on success
+	status := extract(true)
+	if status == event_extracted {
+		return event, true
+	} else if status == esc_wait {
+		esc_wait_timer = time.NewTimer(esc_wait_for)
+		esc_timeout = esc_wait_timer.C
+	}
+
+	for {
+		select {
+		case ev := <-input_comm:
+			if esc_wait_timer != nil {
+				if !esc_wait_timer.Stop() {
+					<-esc_wait_timer.C
+				}
+				esc_wait_timer = nil
+			}
+
+			if ev.err != nil {
+				return Event{Type: EventError, Err: ev.err}, true
+			}
+
+			inbuf = append(inbuf, ev.data...)
+			input_comm <- ev
+			status := extract(true)
+			if status == event_extracted {
+				return event, true
+			} else if status == esc_wait {
+				esc_wait_timer = time.NewTimer(esc_wait_for)
+				esc_timeout = esc_wait_timer.C
+			}
+		case <-esc_timeout:
+			esc_wait_timer = nil
+
+			status := extract(false)
+			for status != event_extracted && len(inbuf) > 0 && !utf8.FullRune(inbuf) {
+				// the rest of the rune didn't arrive in time, skip the
+				// lead byte so that it doesn't block the input after it
+				copy(inbuf, inbuf[1:])
+				inbuf = inbuf[:len(inbuf)-1]
+				status = extract(false)
+			}
+			if status == event_extracted {
+				return event, true
+			}
+		case <-inject_comm:
+			if ev, ok := pop_injected(); ok {
+				if esc_wait_timer != nil {
+					esc_wait_timer.Stop()
+				}
+				return ev, true
+			}
+		case <-done:
+			if esc_wait_timer != nil {
+				esc_wait_timer.Stop()
+			}
+			return Event{Type: EventNone}, false
+		case <-interrupt_comm:
+			event.Type = EventInterrupt
+			return event, true
+
+		case <-sigwinch:
+			if esc_wait_timer != nil {
+				esc_wait_timer.Stop()
+			}
+			wait_resize_settle()
+			event.Type = EventResize
+			event.Width, event.Height = report_resize()
+			return event, true
+		}
+	}
+}
+
+// Merges the key events identical to 'event' which follow it in 'inbuf' into
+// it, see InputCoalesce.
+func coalesce_key_repeats(event *Event) {
+	if event.Type != EventKey {
+		return
+	}
+	event.Repeat = 1
+	for len(inbuf) > 0 {
+		next := Event{Type: EventKey}
+		if extract_event(inbuf, &next, true) != event_extracted {
+			return
+		}
+		if next.Type != EventKey || next.Key != event.Key ||
+			next.Ch != event.Ch || next.Mod != event.Mod {
+			return
+		}
+		copy(inbuf, inbuf[next.N:])
+		inbuf = inbuf[:len(inbuf)-next.N]
+		event.Repeat++
+	}
+}
+
+// Returns the event PollEvent would return next, if it's already in 'inbuf'
+// (or injected), without removing it. The bytes which can't be parsed are
+// skipped just like poll_event does, but left in the buffer.
+func peek_event() (Event, bool) {
+	if ev, ok := peek_injected(); ok {
+		return ev, true
+	}
+
+	api_lock.Lock()
+	defer api_lock.Unlock()
+	buf := inbuf
+	for len(buf) > 0 {
+		event := Event{Type: EventKey}
+		status := extract_event(buf, &event, true)
+		if status == event_extracted {
+			return event, true
+		}
+		if status == esc_wait || event.N == 0 {
+			// an incomplete sequence, more input is needed
+			break
+		}
+		buf = buf[event.N:]
+	}
+	return Event{}, false
+}
+
+// Reads the input until the answer to the cursor position query ("\033[row;colR")
+// arrives and removes it from 'inbuf'. The rest of the input stays in 'inbuf'
+// for poll_event.
+func read_cursor_position(timeout time.Duration) (int, int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if x, y, ok := extract_cursor_position(); ok {
+			return x, y, nil
+		}
+		select {
+		case ev := <-input_comm:
+			if ev.err != nil {
+				// let PollEvent report the error as well
+				push_injected(Event{Type: EventError, Err: ev.err})
+				return 0, 0, ev.err
+			}
+			inbuf = append(inbuf, ev.data...)
+			input_comm <- ev
+		case <-timer.C:
+			return 0, 0, errors.New("termbox: no response to the cursor position query")
+		}
+	}
+}
+
+// Finds the first cursor position report in 'inbuf' and cuts it out. Returns
+// zero based coordinates.
+func extract_cursor_position() (int, int, bool) {
+	for i := 0; i+1 < len(inbuf); i++ {
+		if inbuf[i] != '\033' || inbuf[i+1] != '[' {
+			continue
+		}
+		j := i + 2
+		row, n := parse_decimal(inbuf[j:])
+		if n == 0 || j+n >= len(inbuf) || inbuf[j+n] != ';' {
+			continue
+		}
+		j += n + 1
+		col, n := parse_decimal(inbuf[j:])
+		if n == 0 || j+n >= len(inbuf) || inbuf[j+n] != 'R' {
+			continue
+		}
+		j += n + 1
+		inbuf = append(inbuf[:i], inbuf[j:]...)
+		return col - 1, row - 1, true
+	}
+	return 0, 0, false
+}
+
+// Parses the decimal number at the beginning of 'b'. Returns the number and
+// the count of its digits.
+func parse_decimal(b []byte) (int, int) {
+	v, n := 0, 0
+	for n < len(b) && b[n] >= '0' && b[n] <= '9' {
+		v = v*10 + int(b[n]-'0')
+		n++
+	}
+	return v, n
+}
+
+// Waits until no more SIGWINCH signals arrive for a short while, so that
+// dragging the window border results in a single EventResize with the final
+// size instead of a flood of them.
+func wait_resize_settle() {
+	const settle_delay = 20 * time.Millisecond
+
+	timer := time.NewTimer(settle_delay)
+	for {
+		select {
+		case <-sigwinch:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(settle_delay)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Returns how long poll_event waits for the rest of a partially read escape
+// sequence. Partial sequences other than a lone ESC are waited for even if
+// the escape delay is disabled.
+func esc_wait_delay() time.Duration {
+	if esc_delay > 0 {
+		return esc_delay
+	}
+	return 50 * time.Millisecond
+}
+
+// Reads the input on SIGIO and passes it to the poll_event function through
+// 'input_comm'. Exits when 'quit' is closed or after a read error has been
+// passed on, EOF (e.g. the terminal went away) is reported as io.EOF.
+func input_event_producer() {
+	defer close(input_done)
+	buf := make([]byte, 128)
+	for {
+		select {
+		case <-sigio:
+			for {
+				n, err := syscall.Read(in, buf)
+				if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+					break
+				}
+				if err == syscall.EINTR {
+					continue
+				}
+				if n < 0 {
+					n = 0
+				}
+				if n == 0 && err == nil {
+					err = io.EOF
+				}
+				select {
+				case input_comm <- input_event{buf[:n], err}:
+					if err != nil {
+						// the consumer doesn't send the buffer
+						// back in that case
+						return
+					}
+					ie := <-input_comm
+					buf = ie.data[:128]
+				case <-quit:
+					return
+				}
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
 func fcntl(fd int, cmd int, arg int) (val int, err error) {
 	r, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(cmd),
 		uintptr(arg))
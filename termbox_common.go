@@ -2,16 +2,68 @@ package termbox
 
 // private API, common OS agnostic part
 
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
 type cellbuf struct {
 	width  int
 	height int
 	cells  []Cell
+	extras []cell_extra
+
+	// rows changed since the last Flush, only the rows of the back buffer
+	// which are dirty are compared with the front buffer
+	dirty []bool
+}
+
+// Cell data which doesn't fit into the public Cell type, 'extras' slice of a
+// cellbuf has one for each cell. The slices are never modified in place, they
+// can be shared between buffers.
+type cell_extra struct {
+	comb    []rune    // combining characters drawn on top of the cell's rune
+	link    string    // hyperlink target, see SetLink
+	ulcolor Attribute // underline color, see SetUnderlineColor
+}
+
+func (this *cell_extra) equal(other *cell_extra) bool {
+	if this.link != other.link || this.ulcolor != other.ulcolor {
+		return false
+	}
+	if len(this.comb) != len(other.comb) {
+		return false
+	}
+	for i, r := range this.comb {
+		if other.comb[i] != r {
+			return false
+		}
+	}
+	return true
 }
 
 func (this *cellbuf) init(width, height int) {
 	this.width = width
 	this.height = height
 	this.cells = make([]Cell, width*height)
+	this.extras = make([]cell_extra, width*height)
+	this.dirty = make([]bool, height)
+	this.mark_dirty(0, height)
+}
+
+// Marks the rows from 'y0' up to, but not including, 'y1' dirty.
+func (this *cellbuf) mark_dirty(y0, y1 int) {
+	y0, y1 = max_int(y0, 0), min_int(y1, this.height)
+	for y := y0; y < y1; y++ {
+		this.dirty[y] = true
+	}
+}
+
+// Returns true if the row has to be compared with the front buffer by Flush.
+func (this *cellbuf) is_dirty(y int) bool {
+	return this.dirty[y] || full_redraw || cells_exposed
 }
 
 func (this *cellbuf) resize(width, height int) {
@@ -22,6 +74,7 @@ func (this *cellbuf) resize(width, height int) {
 	oldw := this.width
 	oldh := this.height
 	oldcells := this.cells
+	oldextras := this.extras
 
 	this.init(width, height)
 	this.clear()
@@ -40,6 +93,7 @@ func (this *cellbuf) resize(width, height int) {
 		src := oldcells[srco : srco+minw]
 		dst := this.cells[dsto : dsto+minw]
 		copy(dst, src)
+		copy(this.extras[dsto:dsto+minw], oldextras[srco:srco+minw])
 	}
 }
 
@@ -49,7 +103,301 @@ func (this *cellbuf) clear() {
 		c.Ch = ' '
 		c.Fg = foreground
 		c.Bg = background
+		this.extras[i] = cell_extra{}
+	}
+	this.mark_dirty(0, this.height)
+}
+
+func (this *cellbuf) set(x, y int, ch rune, fg, bg Attribute) {
+	if x < 0 || x >= this.width {
+		return
+	}
+	if y < 0 || y >= this.height {
+		return
 	}
+
+	i := y*this.width + x
+	this.cells[i] = Cell{ch, fg, bg}
+	this.extras[i].comb = nil
+	this.dirty[y] = true
+}
+
+// Returns the rectangle covering the whole buffer.
+func (this *cellbuf) bounds() Rect {
+	return Rect{0, 0, this.width, this.height}
+}
+
+// Fills the rectangle with the cell, the parts outside of the buffer are
+// clipped.
+func (this *cellbuf) fill(r Rect, cell Cell) {
+	r = r.Intersect(this.bounds())
+	this.mark_dirty(r.Y, r.Y+r.H)
+	for cy := r.Y; cy < r.Y+r.H; cy++ {
+		line_offset := cy * this.width
+		for cx := r.X; cx < r.X+r.W; cx++ {
+			this.cells[line_offset+cx] = cell
+			this.extras[line_offset+cx].comb = nil
+		}
+	}
+}
+
+// See Blit and BlitTransparent.
+func (this *cellbuf) blit(x, y, w int, cells []Cell, transparent bool) int {
+	if w <= 0 {
+		return 0
+	}
+	h := (len(cells) + w - 1) / w
+	r := Rect{x, y, w, h}.Intersect(this.bounds())
+
+	n := 0
+	for cy := r.Y; cy < r.Y+r.H; cy++ {
+		src := (cy-y)*w - x
+		dst := cy * this.width
+		for cx := r.X; cx < r.X+r.W && src+cx < len(cells); cx++ {
+			if transparent && cells[src+cx].Ch == 0 {
+				continue
+			}
+			this.cells[dst+cx] = cells[src+cx]
+			this.extras[dst+cx].comb = nil
+			this.dirty[cy] = true
+			n++
+		}
+	}
+	return n
+}
+
+// Draws 'src' on top of the buffer with its top-left corner at 'x', 'y'. The
+// cells of 'src' with zero 'Ch' are transparent.
+func (this *cellbuf) compose(src *cellbuf, x, y int) {
+	r := Rect{x, y, src.width, src.height}.Intersect(this.bounds())
+	for cy := r.Y; cy < r.Y+r.H; cy++ {
+		srco := (cy-y)*src.width - x
+		dsto := cy * this.width
+		for cx := r.X; cx < r.X+r.W; cx++ {
+			if src.cells[srco+cx].Ch == 0 {
+				continue
+			}
+			this.cells[dsto+cx] = src.cells[srco+cx]
+			this.extras[dsto+cx] = src.extras[srco+cx]
+			this.dirty[cy] = true
+		}
+	}
+}
+
+// Copies the 'w' by 'h' rectangle at 'sx', 'sy' to 'dx', 'dy' (with the
+// extras). Works like memmove, the rectangles may overlap. The parts which lie
+// outside of the buffer, either at the source or at the destination, are
+// skipped.
+func (this *cellbuf) copy_region(sx, sy, w, h, dx, dy int) {
+	if sx < 0 {
+		w, dx, sx = w+sx, dx-sx, 0
+	}
+	if dx < 0 {
+		w, sx, dx = w+dx, sx-dx, 0
+	}
+	if sy < 0 {
+		h, dy, sy = h+sy, dy-sy, 0
+	}
+	if dy < 0 {
+		h, sy, dy = h+dy, sy-dy, 0
+	}
+	w = min_int(w, min_int(this.width-sx, this.width-dx))
+	h = min_int(h, min_int(this.height-sy, this.height-dy))
+	if w <= 0 || h <= 0 {
+		return
+	}
+	this.mark_dirty(dy, dy+h)
+
+	copy_row := func(i int) {
+		src, dst := (sy+i)*this.width+sx, (dy+i)*this.width+dx
+		copy(this.cells[dst:dst+w], this.cells[src:src+w])
+		copy(this.extras[dst:dst+w], this.extras[src:src+w])
+	}
+	// rows are copied away from the destination, copy() itself handles
+	// overlapping within a row
+	if dy > sy {
+		for i := h - 1; i >= 0; i-- {
+			copy_row(i)
+		}
+	} else {
+		for i := 0; i < h; i++ {
+			copy_row(i)
+		}
+	}
+}
+
+const (
+	// RGB colors have this bit set, the RGB triplet itself is kept in the
+	// lower 24 bits, see RGBToAttribute
+	attr_rgb = Attribute(1 << 24)
+
+	// all the bits of an attribute which are used by colors
+	attr_color_mask = attr_rgb | 0xFFFFFF
+)
+
+// see OnResize function
+var (
+	resize_funcs   []func(w, h int)
+	resize_pending bool // the buffers were resized, the callbacks weren't called
+)
+
+// Calls the OnResize callbacks if the buffers were resized since the last
+// call. It's deferred by the API functions which may resize the buffers
+// before they lock 'api_lock', so that it runs after the lock is released and
+// the callbacks are free to use the API.
+func call_resize_funcs() {
+	api_lock.Lock()
+	if !resize_pending {
+		api_lock.Unlock()
+		return
+	}
+	resize_pending = false
+	fns, w, h := resize_funcs, back_buffer.width, back_buffer.height
+	api_lock.Unlock()
+
+	for _, f := range fns {
+		f(w, h)
+	}
+}
+
+// see Events function
+var (
+	events_comm chan Event
+	events_quit chan struct{}
+	events_done chan struct{}
+)
+
+func events_producer(comm chan<- Event, quit, done chan struct{}) {
+	defer close(done)
+	defer close(comm)
+	for {
+		ev, ok := poll_event(quit)
+		if !ok {
+			return
+		}
+		select {
+		case comm <- ev:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// stops the goroutine started by Events function, if any, and waits for it
+func stop_events() {
+	api_lock.Lock()
+	quit, done := events_quit, events_done
+	events_comm = nil
+	events_quit = nil
+	events_done = nil
+	api_lock.Unlock()
+
+	if quit == nil {
+		return
+	}
+	close(quit)
+	<-done
+}
+
+// see Capabilities, filled in by Init
+var caps TerminalCapabilities
+
+// see CloseOnSignal
+var close_signals chan os.Signal
+
+func start_close_signals() {
+	if close_signals != nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	close_signals = c
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	go func() {
+		sig, ok := <-c
+		if !ok {
+			return
+		}
+		Close()
+		// the conventional exit status of a process killed by a signal
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
+
+func stop_close_signals() {
+	if close_signals == nil {
+		return
+	}
+	signal.Stop(close_signals)
+	close(close_signals)
+	close_signals = nil
+}
+
+// Serializes the functions which work with the buffers and the output, see
+// SetCell. The event functions don't take it, so that drawing isn't blocked
+// while PollEvent waits.
+var api_lock sync.Mutex
+
+// see ChangedCells and SetFullRedraw, 'cells_exposed' is set by CellBuffer,
+// the cells may be changed behind our back then, so the dirty rows can't be
+// trusted
+var (
+	changed_cells int
+	full_redraw   bool
+	cells_exposed bool
+)
+
+func set_cell(x, y int, ch rune, fg, bg Attribute) {
+	back_buffer.set(x, y, ch, fg, bg)
+}
+
+// events queued by InjectEvent, 'inject_comm' wakes up poll_event
+var (
+	injected      []Event
+	injected_lock sync.Mutex
+	inject_comm   = make(chan struct{}, 1)
+)
+
+func push_injected(ev Event) {
+	injected_lock.Lock()
+	injected = append(injected, ev)
+	injected_lock.Unlock()
+	select {
+	case inject_comm <- struct{}{}:
+	default:
+	}
+}
+
+func drop_injected() {
+	injected_lock.Lock()
+	injected = nil
+	injected_lock.Unlock()
+}
+
+func pop_injected() (Event, bool) {
+	injected_lock.Lock()
+	defer injected_lock.Unlock()
+	if len(injected) == 0 {
+		return Event{}, false
+	}
+	ev := injected[0]
+	injected = injected[1:]
+	return ev, true
+}
+
+func peek_injected() (Event, bool) {
+	injected_lock.Lock()
+	defer injected_lock.Unlock()
+	if len(injected) == 0 {
+		return Event{}, false
+	}
+	return injected[0], true
+}
+
+// Puts the event back to the front of the queue, see peek_event.
+func unpop_injected(ev Event) {
+	injected_lock.Lock()
+	injected = append([]Event{ev}, injected...)
+	injected_lock.Unlock()
 }
 
 const cursor_hidden = -1
@@ -57,3 +405,17 @@ const cursor_hidden = -1
 func is_cursor_hidden(x, y int) bool {
 	return x == cursor_hidden || y == cursor_hidden
 }
+
+func min_int(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max_int(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,269 @@
+package termbox
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Opens a new pseudo-terminal pair of the given size, the test is skipped if
+// there are no pseudo-terminals. Both files are closed when the test ends.
+func open_pty(t *testing.T, w, h int) (master, slave *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("no pseudo-terminals:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	var n, unlock uint32
+	if err := pty_ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		t.Skip("can't unlock the pseudo-terminal:", err)
+	}
+	if err := pty_ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		t.Skip("can't get the pseudo-terminal number:", err)
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("can't open the pseudo-terminal:", err)
+	}
+	t.Cleanup(func() { slave.Close() })
+
+	sz := winsize{rows: uint16(h), cols: uint16(w)}
+	if err := pty_ioctl(master, syscall.TIOCSWINSZ, unsafe.Pointer(&sz)); err != nil {
+		t.Fatal(err)
+	}
+	return master, slave
+}
+
+// Returns the number of open file descriptors of the process.
+func open_fds(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't list the open descriptors:", err)
+	}
+	return len(fds)
+}
+
+func pty_ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func TestInitCloseDoesNotLeakGoroutines(t *testing.T) {
+	_, slave := open_pty(t, 80, 24)
+
+	cycle := func() {
+		if err := InitWithFiles(slave, slave); err != nil {
+			t.Fatal(err)
+		}
+		Close()
+	}
+	// the first cycle starts the goroutines of os/signal which stay
+	cycle()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		cycle()
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after 100 Init/Close cycles, %d before", after, before)
+	}
+}
+
+func TestPartialRuneTimesOut(t *testing.T) {
+	master, slave := open_pty(t, 80, 24)
+	if err := InitWithFiles(slave, slave); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	events := make(chan Event, 1)
+	go func() { events <- PollEvent() }()
+
+	// the first two bytes of '€', the rest arrives after the escape delay
+	// and must not complete the rune anymore
+	master.Write([]byte{0xE2, 0x82})
+	time.Sleep(4 * esc_wait_delay())
+	master.Write([]byte{0xAC, 'x'})
+
+	select {
+	case ev := <-events:
+		if ev.Type != EventKey || ev.Ch != 'x' {
+			t.Errorf("got %+v, want the 'x' key", ev)
+		}
+	case <-time.After(time.Second):
+		Interrupt()
+		t.Errorf("no event after a partial rune, got %+v", <-events)
+	}
+}
+
+func TestNoSignalsWithoutSize(t *testing.T) {
+	_, slave := open_pty(t, 0, 0)
+	fds := open_fds(t)
+	if err := InitWithFiles(slave, slave); err == nil {
+		Close()
+		t.Fatal("InitWithFiles succeeded on a terminal without a size")
+	}
+	if n := open_fds(t); n != fds {
+		t.Errorf("%d open descriptors after the failed InitWithFiles, %d before", n, fds)
+	}
+
+	if err := InitWithFilesOptions(slave, slave, InitOptions{NoSignals: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	if w, h := Size(); w != 0 || h != 0 {
+		t.Errorf("Size() = %dx%d, want 0x0", w, h)
+	}
+	SetSize(20, 10)
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := Size(); w != 20 || h != 10 {
+		t.Errorf("Size() = %dx%d after SetSize(20, 10)", w, h)
+	}
+}
+
+// Meant to be run with the race detector.
+func TestSetInputModeWhilePolling(t *testing.T) {
+	master, slave := open_pty(t, 80, 24)
+	if err := InitWithFiles(slave, slave); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	const n = 100
+	go func() {
+		for i := 0; i < n; i++ {
+			master.Write([]byte("a\033[A"))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			SetInputMode(InputAlt | InputMouse)
+			SetInputMode(InputEsc)
+			SetKeypadMode(i%2 == 0)
+			SetEscDelay(0)
+			SetCell(i%80, 0, 'x', ColorDefault, ColorDefault)
+			Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 2*n; i++ {
+		if ev := PollEvent(); ev.Type == EventError {
+			t.Fatal(ev.Err)
+		}
+	}
+	<-done
+}
+
+func TestInitFailureCleansUp(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// a pipe has no terminal attributes, so tcgetattr fails after the
+	// signals have been set up
+	fds := open_fds(t)
+	if err := InitWithFilesOptions(r, w, InitOptions{NoSignals: true}); err == nil {
+		Close()
+		t.Fatal("InitWithFilesOptions succeeded on a pipe")
+	}
+	if n := open_fds(t); n != fds {
+		t.Errorf("%d open descriptors after the failed initialization, %d before", n, fds)
+	}
+
+	select {
+	case <-sigio:
+	default:
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGIO)
+	select {
+	case <-sigio:
+		t.Error("SIGIO is still delivered after the failed initialization")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAltKeySplitAcrossReads(t *testing.T) {
+	master, slave := open_pty(t, 80, 24)
+	err := InitWithFilesOptions(slave, slave, InitOptions{
+		InputMode: InputAlt,
+		EscDelay:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	for c := 'a'; c <= 'z'; c++ {
+		events := make(chan Event, 1)
+		go func() { events <- PollEvent() }()
+		// ESC and the letter arrive separately, within the escape delay
+		master.Write([]byte{'\033'})
+		time.Sleep(10 * time.Millisecond)
+		start := time.Now()
+		master.Write([]byte{byte(c)})
+
+		ev := <-events
+		if ev.Type != EventKey || ev.Ch != c || ev.Key != 0 || ev.Mod != ModAlt {
+			t.Errorf("Alt+%c: got %+v", c, ev)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("Alt+%c: reported %v after the letter, the rest of the escape delay was waited for", c, d)
+		}
+	}
+}
+
+func TestBracketedPasteAcrossReads(t *testing.T) {
+	master, slave := open_pty(t, 80, 24)
+	if err := InitWithFilesOptions(slave, slave, InitOptions{InputMode: InputPaste}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	events := make(chan Event, 1)
+	go func() { events <- PollEvent() }()
+	// the escape delay must not cut the paste short
+	for _, chunk := range []string{"\033[200~one\033", "[Atwo", "\033[201~"} {
+		master.Write([]byte(chunk))
+		time.Sleep(2 * esc_wait_delay())
+	}
+	if ev := <-events; ev.Type != EventPaste || ev.Paste != "one\033[Atwo" {
+		t.Errorf("got %+v, want the paste %q", ev, "one\033[Atwo")
+	}
+}
+
+func TestCloseRestoresEscDelay(t *testing.T) {
+	_, slave := open_pty(t, 80, 24)
+	if err := InitWithFilesOptions(slave, slave, InitOptions{EscDelay: -1}); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if esc_delay != default_esc_delay {
+		t.Errorf("the escape delay is %v after Close, want the default %v", esc_delay, default_esc_delay)
+	}
+
+	if err := InitWithFiles(slave, slave); err != nil {
+		t.Fatal(err)
+	}
+	SetEscDelay(time.Second)
+	Close()
+	if esc_delay != default_esc_delay {
+		t.Errorf("the escape delay is %v after Close, want the default %v", esc_delay, default_esc_delay)
+	}
+}
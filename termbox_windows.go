@@ -1,6 +1,7 @@
 package termbox
 
 import "math"
+import "sync"
 import "syscall"
 import "unsafe"
 import "unicode/utf16"
@@ -70,6 +71,9 @@ const (
 	mouse_mmb = 0x4 | 0x8 | 0x10
 	SM_CXMIN  = 28
 	SM_CYMIN  = 29
+
+	// not in syscalls_windows.go, see InputFocus
+	focus_event = 0x10
 )
 
 func (this coord) uintptr() uintptr {
@@ -105,7 +109,10 @@ var (
 	proc_wait_for_multiple_objects        = kernel32.NewProc("WaitForMultipleObjects")
 	proc_set_event                        = kernel32.NewProc("SetEvent")
 	proc_get_current_console_font         = kernel32.NewProc("GetCurrentConsoleFont")
+	proc_get_console_title                = kernel32.NewProc("GetConsoleTitleW")
+	proc_set_console_title                = kernel32.NewProc("SetConsoleTitleW")
 	get_system_metrics                    = moduser32.NewProc("GetSystemMetrics")
+	message_beep                          = moduser32.NewProc("MessageBeep")
 )
 
 func set_console_active_screen_buffer(h syscall.Handle) (err error) {
@@ -380,6 +387,25 @@ func get_current_console_font(h syscall.Handle, info *console_font_info) (err er
 	return
 }
 
+func get_console_title(buf []uint16) int {
+	r0, _, _ := syscall.Syscall(proc_get_console_title.Addr(),
+		2, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0)
+	return int(r0)
+}
+
+func set_console_title(title *uint16) (err error) {
+	r0, _, e1 := syscall.Syscall(proc_set_console_title.Addr(),
+		1, uintptr(unsafe.Pointer(title)), 0, 0)
+	if int(r0) == 0 {
+		if e1 != 0 {
+			err = error(e1)
+		} else {
+			err = syscall.EINVAL
+		}
+	}
+	return
+}
+
 type diff_msg struct {
 	pos   short
 	lines short
@@ -397,12 +423,15 @@ var (
 	orig_window      small_rect
 	orig_mode        dword
 	orig_screen      syscall.Handle
+	orig_title       []uint16
 	back_buffer      cellbuf
 	front_buffer     cellbuf
 	term_size        coord
 	input_mode       = InputEsc
+	mode_lock        sync.Mutex // guards input_mode, see set_input_mode
 	cursor_x         = cursor_hidden
 	cursor_y         = cursor_hidden
+	cursor_size      = dword(100)
 	foreground       = ColorDefault
 	background       = ColorDefault
 	in               syscall.Handle
@@ -418,6 +447,7 @@ var (
 	cancel_comm      = make(chan bool, 1)
 	cancel_done_comm = make(chan bool)
 	alt_mode_esc     = false
+	suspended        bool
 
 	// these ones just to prevent heap allocs at all costs
 	tmp_info   console_screen_buffer_info
@@ -498,12 +528,19 @@ func fix_win_size(out syscall.Handle, size coord) (err error) {
 	return set_console_window_info(out, &window)
 }
 
+// Returns true if there's output waiting for the next Flush, see Dirty. The
+// console functions are not buffered, so there's never any.
+func pending_output() bool {
+	return false
+}
+
 func update_size_maybe() {
 	size := get_win_size(out)
 	if size.x != term_size.x || size.y != term_size.y {
 		set_console_screen_buffer_size(out, size)
 		fix_win_size(out, size)
 		term_size = size
+		resize_pending = true
 		back_buffer.resize(int(size.x), int(size.y))
 		front_buffer.resize(int(size.x), int(size.y))
 		front_buffer.clear()
@@ -557,10 +594,13 @@ func append_diff_line(y int) int {
 		front := &front_buffer.cells[cell_offset]
 		attr, char := cell_to_char_info(*back)
 		charbuf = append(charbuf, char_info{attr: attr, char: char[0]})
+		if full_redraw || !CellsEqual(*back, *front) {
+			changed_cells++
+		}
 		*front = *back
 		n++
-		w := runewidth.RuneWidth(back.Ch)
-		if w == 0 || w == 2 && runewidth.IsAmbiguousWidth(back.Ch) {
+		w := RuneWidth(back.Ch)
+		if w == 0 {
 			w = 1
 		}
 		x += w
@@ -582,13 +622,15 @@ func prepare_diff_messages() {
 	var diff diff_msg
 	gbeg := 0
 	for y := 0; y < front_buffer.height; y++ {
-		same := true
+		dirty := back_buffer.is_dirty(y)
+		back_buffer.dirty[y] = false
+		same := !full_redraw
 		line_offset := y * front_buffer.width
-		for x := 0; x < front_buffer.width; x++ {
+		for x := 0; dirty && same && x < front_buffer.width; x++ {
 			cell_offset := line_offset + x
 			back := &back_buffer.cells[cell_offset]
 			front := &front_buffer.cells[cell_offset]
-			if *back != *front {
+			if !CellsEqual(*back, *front) {
 				same = false
 				break
 			}
@@ -623,6 +665,20 @@ func get_ct(table []word, idx int) word {
 }
 
 func cell_to_char_info(c Cell) (attr word, wc [2]wchar) {
+	// RGB colors are not supported, fall back to the default ones
+	if c.Fg&attr_rgb != 0 {
+		c.Fg &^= attr_color_mask
+	}
+	if c.Bg&attr_rgb != 0 {
+		c.Bg &^= attr_color_mask
+	}
+	// bright colors are the basic ones with the intensity bit set
+	if col := c.Fg & 0x1F; col > ColorWhite && col <= ColorLightGray {
+		c.Fg = c.Fg&^0x1F | (col - 8) | AttrBold
+	}
+	if col := c.Bg & 0x1F; col > ColorWhite && col <= ColorLightGray {
+		c.Bg = c.Bg&^0x1F | (col - 8) | AttrBold
+	}
 	attr = get_ct(color_table_fg, int(c.Fg)) | get_ct(color_table_bg, int(c.Bg))
 	if c.Fg&AttrReverse|c.Bg&AttrReverse != 0 {
 		attr = (attr&0xF0)>>4 | (attr&0x0F)<<4
@@ -645,6 +701,132 @@ func cell_to_char_info(c Cell) (attr word, wc [2]wchar) {
 	return
 }
 
+// Waits for an event and returns it. Returns false if 'done' was closed before
+// an event arrived.
+func poll_event(done <-chan struct{}) (Event, bool) {
+	for {
+		if ev, ok := pop_injected(); ok {
+			return ev, true
+		}
+		select {
+		case ev := <-input_comm:
+			mode_lock.Lock()
+			mode := input_mode
+			mode_lock.Unlock()
+			if mode&InputCoalesce != 0 {
+				coalesce_key_repeats(&ev)
+			}
+			return ev, true
+		case <-interrupt_comm:
+			return Event{Type: EventInterrupt}, true
+		case <-inject_comm:
+		case <-done:
+			return Event{Type: EventNone}, false
+		}
+	}
+}
+
+// Merges the key events identical to 'event' which are ready in 'input_comm'
+// into it, see InputCoalesce. The first different event is put to the front of
+// the injected events queue.
+func coalesce_key_repeats(event *Event) {
+	if event.Type != EventKey {
+		return
+	}
+	event.Repeat = 1
+	for {
+		select {
+		case next := <-input_comm:
+			if next.Type != EventKey || next.Key != event.Key ||
+				next.Ch != event.Ch || next.Mod != event.Mod {
+				unpop_injected(next)
+				return
+			}
+			event.Repeat++
+		default:
+			return
+		}
+	}
+}
+
+// Returns the event poll_event would return next, if it's ready, without
+// removing it. An event taken from the input goroutine is put to the front of
+// the injected events queue, which poll_event checks first.
+func peek_event() (Event, bool) {
+	if ev, ok := peek_injected(); ok {
+		return ev, true
+	}
+	select {
+	case ev := <-input_comm:
+		unpop_injected(ev)
+		return ev, true
+	default:
+	}
+	return Event{}, false
+}
+
+// Sends the changes of the back buffer to the console, see Flush.
+func present() error {
+	if suspended {
+		return nil
+	}
+	changed_cells = 0
+	update_size_maybe()
+	prepare_diff_messages()
+	for _, diff := range diffbuf {
+		chars := []char_info{}
+		for _, char := range diff.chars {
+			chars = append(chars, char)
+			if RuneWidth(rune(char.char)) > 1 {
+				chars = append(chars, char_info{
+					char: ' ',
+					attr: char.attr,
+				})
+			}
+		}
+		r := small_rect{
+			left:   0,
+			top:    diff.pos,
+			right:  term_size.x - 1,
+			bottom: diff.pos + diff.lines - 1,
+		}
+		err := write_console_output(out, chars, r)
+		if err != nil {
+			return err
+		}
+	}
+	if !is_cursor_hidden(cursor_x, cursor_y) {
+		move_cursor(cursor_x, cursor_y)
+	}
+	return nil
+}
+
+func set_cursor(x, y int) {
+	if is_cursor_hidden(cursor_x, cursor_y) && !is_cursor_hidden(x, y) {
+		show_cursor(true)
+	}
+
+	if !is_cursor_hidden(cursor_x, cursor_y) && is_cursor_hidden(x, y) {
+		show_cursor(false)
+	}
+
+	cursor_x, cursor_y = x, y
+	if !is_cursor_hidden(cursor_x, cursor_y) {
+		move_cursor(cursor_x, cursor_y)
+	}
+}
+
+// stops the goroutine started by Init, see input_event_producer
+func stop_input() {
+	cancel_comm <- true
+	set_event(interrupt)
+	select {
+	case <-input_comm:
+	default:
+	}
+	<-cancel_done_comm
+}
+
 func move_cursor(x, y int) {
 	err := set_console_cursor_position(out, coord{short(x), short(y)})
 	if err != nil {
@@ -652,6 +834,29 @@ func move_cursor(x, y int) {
 	}
 }
 
+// Switches the console to the input mode, see SetInputMode.
+// While suspended the mode is only recorded, Resume switches to it.
+func set_input_mode(mode InputMode) {
+	mode_lock.Lock()
+	input_mode = mode
+	mode_lock.Unlock()
+	if suspended {
+		return
+	}
+	err := set_console_mode(in, input_console_mode())
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the console input mode flags for 'input_mode'.
+func input_console_mode() dword {
+	if input_mode&InputMouse != 0 {
+		return enable_window_input | enable_mouse_input | enable_extended_flags
+	}
+	return enable_window_input
+}
+
 func show_cursor(visible bool) {
 	var v int32
 	if visible {
@@ -659,7 +864,7 @@ func show_cursor(visible bool) {
 	}
 
 	var info console_cursor_info
-	info.size = 100
+	info.size = cursor_size
 	info.visible = v
 	err := set_console_cursor_info(out, &info)
 	if err != nil {
@@ -689,13 +894,27 @@ func clear() {
 	}
 }
 
-func key_event_record_to_event(r *key_event_record) (Event, bool) {
+// Returns ModCtrl and ModShift modifiers for the keys which don't have Ctrl or
+// Shift variants among Key* constants.
+func key_modifiers(state dword) Modifier {
+	var mod Modifier
+	if state&(left_ctrl_pressed|right_ctrl_pressed) != 0 {
+		mod |= ModCtrl
+	}
+	if state&shift_pressed != 0 {
+		mod |= ModShift
+	}
+	return mod
+}
+
+// Converts the key record according to the input mode 'mode'.
+func key_event_record_to_event(r *key_event_record, mode InputMode) (Event, bool) {
 	if r.key_down == 0 {
 		return Event{}, false
 	}
 
 	e := Event{Type: EventKey}
-	if input_mode&InputAlt != 0 {
+	if mode&InputAlt != 0 {
 		if alt_mode_esc {
 			e.Mod = ModAlt
 			alt_mode_esc = false
@@ -708,6 +927,7 @@ func key_event_record_to_event(r *key_event_record) (Event, bool) {
 	ctrlpressed := r.control_key_state&(left_ctrl_pressed|right_ctrl_pressed) != 0
 
 	if r.virtual_key_code >= vk_f1 && r.virtual_key_code <= vk_f12 {
+		e.Mod |= key_modifiers(r.control_key_state)
 		switch r.virtual_key_code {
 		case vk_f1:
 			e.Key = KeyF1
@@ -740,6 +960,13 @@ func key_event_record_to_event(r *key_event_record) (Event, bool) {
 		return e, true
 	}
 
+	if r.virtual_key_code > vk_f12 && r.virtual_key_code <= vk_f12+12 {
+		// F13-F24 virtual key codes follow F12
+		e.Mod |= key_modifiers(r.control_key_state)
+		e.Key = KeyF13 - Key(r.virtual_key_code-vk_f12-1)
+		return e, true
+	}
+
 	if r.virtual_key_code <= vk_delete {
 		switch r.virtual_key_code {
 		case vk_insert:
@@ -762,6 +989,13 @@ func key_event_record_to_event(r *key_event_record) (Event, bool) {
 			e.Key = KeyArrowLeft
 		case vk_arrow_right:
 			e.Key = KeyArrowRight
+		}
+		if e.Key != 0 {
+			e.Mod |= key_modifiers(r.control_key_state)
+			return e, true
+		}
+
+		switch r.virtual_key_code {
 		case vk_backspace:
 			if ctrlpressed {
 				e.Key = KeyBackspace2
@@ -778,9 +1012,9 @@ func key_event_record_to_event(r *key_event_record) (Event, bool) {
 			}
 		case vk_esc:
 			switch {
-			case input_mode&InputEsc != 0:
+			case mode&InputEsc != 0:
 				e.Key = KeyEsc
-			case input_mode&InputAlt != 0:
+			case mode&InputAlt != 0:
 				alt_mode_esc = true
 				return Event{}, false
 			}
@@ -802,7 +1036,7 @@ func key_event_record_to_event(r *key_event_record) (Event, bool) {
 	if ctrlpressed {
 		if Key(r.unicode_char) >= KeyCtrlA && Key(r.unicode_char) <= KeyCtrlRsqBracket {
 			e.Key = Key(r.unicode_char)
-			if input_mode&InputAlt != 0 && e.Key == KeyEsc {
+			if mode&InputAlt != 0 && e.Key == KeyEsc {
 				alt_mode_esc = true
 				return Event{}, false
 			}
@@ -814,7 +1048,7 @@ func key_event_record_to_event(r *key_event_record) (Event, bool) {
 			e.Key = KeyCtrl2
 			return e, true
 		case 51:
-			if input_mode&InputAlt != 0 {
+			if mode&InputAlt != 0 {
 				alt_mode_esc = true
 				return Event{}, false
 			}
@@ -869,22 +1103,35 @@ func input_event_producer() {
 		if err != nil {
 			input_comm <- Event{Type: EventError, Err: err}
 		}
+		// not api_lock, stop_input waits for this goroutine holding it
+		mode_lock.Lock()
+		mode := input_mode
+		mode_lock.Unlock()
 
 		switch r.event_type {
 		case key_event:
 			kr := (*key_event_record)(unsafe.Pointer(&r.event))
-			ev, ok := key_event_record_to_event(kr)
+			ev, ok := key_event_record_to_event(kr, mode)
 			if ok {
 				for i := 0; i < int(kr.repeat_count); i++ {
 					input_comm <- ev
 				}
 			}
 		case window_buffer_size_event:
-			sr := *(*window_buffer_size_record)(unsafe.Pointer(&r.event))
+			// report the window size, that's what update_size_maybe
+			// resizes the buffers to, the screen buffer size in the
+			// record may be larger
+			size := get_win_size(out)
 			input_comm <- Event{
 				Type:   EventResize,
-				Width:  int(sr.size.x),
-				Height: int(sr.size.y),
+				Width:  int(size.x),
+				Height: int(size.y),
+			}
+		case focus_event:
+			if mode&InputFocus != 0 {
+				// FOCUS_EVENT_RECORD is a single BOOL
+				focused := *(*int32)(unsafe.Pointer(&r.event)) != 0
+				input_comm <- Event{Type: EventFocus, Focus: focused}
 			}
 		case mouse_event:
 			mr := *(*mouse_event_record)(unsafe.Pointer(&r.event))
@@ -921,12 +1168,20 @@ func input_event_producer() {
 			case 1:
 				// mouse motion
 				x, y := int(mr.mouse_pos.x), int(mr.mouse_pos.y)
-				if last_state != 0 && (last_x != x || last_y != y) {
+				if last_x == x && last_y == y {
+					ev.Type = EventNone
+				} else if last_state != 0 {
 					ev.Key = last_button_pressed
 					ev.Mod = ModMotion
 					ev.MouseX = x
 					ev.MouseY = y
 					last_x, last_y = x, y
+				} else if mode&InputMouseMotion != 0 {
+					ev.Key = MouseRelease
+					ev.Mod = ModMotion
+					ev.MouseX = x
+					ev.MouseY = y
+					last_x, last_y = x, y
 				} else {
 					ev.Type = EventNone
 				}
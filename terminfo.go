@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -25,6 +26,38 @@ const (
 	ti_header_length = 12
 	ti_mouse_enter   = "\x1b[?1000h\x1b[?1002h\x1b[?1015h\x1b[?1006h"
 	ti_mouse_leave   = "\x1b[?1006l\x1b[?1015l\x1b[?1002l\x1b[?1000l"
+
+	// any-event tracking, see InputMouseMotion
+	ti_mouse_motion_enter = "\x1b[?1003h"
+	ti_mouse_motion_leave = "\x1b[?1003l"
+
+	// bracketed paste, see InputPaste
+	ti_paste_enter = "\x1b[?2004h"
+	ti_paste_leave = "\x1b[?2004l"
+	ti_paste_begin = "\x1b[200~"
+	ti_paste_end   = "\x1b[201~"
+
+	// focus reporting, see InputFocus
+	ti_focus_enter = "\x1b[?1004h"
+	ti_focus_leave = "\x1b[?1004l"
+	ti_focus_in    = "\x1b[I"
+	ti_focus_out   = "\x1b[O"
+
+	// xterm window title stack, see SetTitle
+	ti_push_title = "\x1b[22;0t"
+	ti_pop_title  = "\x1b[23;0t"
+
+	// restores the palette, see SetPaletteColor
+	ti_reset_palette = "\x1b]104\x07"
+
+	// restore the default colors, see SetDefaultColors
+	ti_reset_default_fg = "\x1b]110\x07"
+	ti_reset_default_bg = "\x1b]111\x07"
+
+	// numbers of the capabilities used by Capabilities, taken from
+	// (ncurses) term.h
+	ti_max_colors = 13  // numeric
+	ti_key_mouse  = 355 // string
 )
 
 func load_terminfo() ([]byte, error) {
@@ -102,10 +135,16 @@ func setup_term_builtin() error {
 		return errors.New("termbox: TERM environment variable not set")
 	}
 
+	caps.Colors = 8
+	if strings.Contains(name, "256color") {
+		caps.Colors = 256
+	}
+
 	for _, t := range terms {
 		if t.name == name {
 			keys = t.keys
 			funcs = t.funcs
+			caps.Mouse = funcs[t_enter_mouse] != ""
 			return nil
 		}
 	}
@@ -120,6 +159,7 @@ func setup_term_builtin() error {
 		{"linux", linux_keys, linux_funcs},
 		{"Eterm", eterm_keys, eterm_funcs},
 		{"screen", screen_keys, screen_funcs},
+		{"tmux", tmux_keys, tmux_funcs},
 		// let's assume that 'cygwin' is xterm compatible
 		{"cygwin", xterm_keys, xterm_funcs},
 		{"st", xterm_keys, xterm_funcs},
@@ -130,11 +170,17 @@ func setup_term_builtin() error {
 		if strings.Contains(name, it.partial) {
 			keys = it.keys
 			funcs = it.funcs
+			caps.Mouse = funcs[t_enter_mouse] != ""
 			return nil
 		}
 	}
 
-	return errors.New("termbox: unsupported terminal")
+	// most terminals nowadays are more or less xterm compatible, that's
+	// a better guess than giving up
+	keys = xterm_keys
+	funcs = xterm_funcs
+	caps.Mouse = true
+	return nil
 }
 
 func setup_term() (err error) {
@@ -166,11 +212,32 @@ func setup_term() (err error) {
 		// old quirk to align everything on word boundaries
 		header[2] += 1
 	}
-	str_offset = ti_header_length + header[1] + header[2] + number_sec_len*header[3]
+	num_offset := ti_header_length + header[1] + header[2]
+	str_offset = num_offset + number_sec_len*header[3]
 	table_offset = str_offset + 2*header[4]
 
-	keys = make([]string, 0xFFFF-key_min)
+	caps.Colors = 0
+	if ti_max_colors < header[3] {
+		caps.Colors, err = ti_read_number(rd, num_offset+number_sec_len*ti_max_colors, number_sec_len)
+		if err != nil {
+			return
+		}
+	}
+	caps.Mouse = false
+	if ti_key_mouse < header[4] {
+		var kmous string
+		kmous, err = ti_read_string(rd, str_offset+2*ti_key_mouse, table_offset)
+		if err != nil {
+			return
+		}
+		caps.Mouse = kmous != ""
+	}
+
+	keys = make([]string, len(ti_keys))
 	for i, _ := range keys {
+		if ti_keys[i] >= header[4] {
+			continue
+		}
 		keys[i], err = ti_read_string(rd, str_offset+2*ti_keys[i], table_offset)
 		if err != nil {
 			return
@@ -180,6 +247,10 @@ func setup_term() (err error) {
 	// the last two entries are reserved for mouse. because the table offset is
 	// not there, the two entries have to fill in manually
 	for i, _ := range funcs[:len(funcs)-2] {
+		if ti_funcs[i] >= header[4] {
+			// the capability is past the end of the strings section
+			continue
+		}
 		funcs[i], err = ti_read_string(rd, str_offset+2*ti_funcs[i], table_offset)
 		if err != nil {
 			return
@@ -190,6 +261,61 @@ func setup_term() (err error) {
 	return nil
 }
 
+// Reads a numeric capability 'size' bytes long, absent ones are returned as 0.
+func ti_read_number(rd *bytes.Reader, num_off, size int16) (int, error) {
+	_, err := rd.Seek(int64(num_off), 0)
+	if err != nil {
+		return 0, err
+	}
+	var n int32
+	if size == 4 {
+		err = binary.Read(rd, binary.LittleEndian, &n)
+	} else {
+		var n16 int16
+		err = binary.Read(rd, binary.LittleEndian, &n16)
+		n = int32(n16)
+	}
+	if err != nil || n < 0 {
+		// the capability is absent (-1) or cancelled (-2)
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Fills in the capabilities which come from the environment rather than from
+// terminfo, see Capabilities.
+func setup_caps_env() {
+	colorterm := os.Getenv("COLORTERM")
+	caps.TrueColor = colorterm == "truecolor" || colorterm == "24bit"
+
+	// styled underlines are described by the extended Smulx capability,
+	// which isn't supported, recognize the terminals known to have them
+	// instead: kitty, WezTerm, foot and VTE based ones since 0.51.2
+	term := os.Getenv("TERM")
+	vte, _ := strconv.Atoi(os.Getenv("VTE_VERSION"))
+	caps.Undercurl = term == "xterm-kitty" || term == "wezterm" ||
+		strings.HasPrefix(term, "foot") ||
+		os.Getenv("TERM_PROGRAM") == "WezTerm" || vte >= 5102
+
+	// the linux console has 8 colors according to terminfo, but draws the
+	// bold ones in 8 more bright colors
+	linux_console = term == "linux"
+	if linux_console {
+		caps.Colors = max_int(caps.Colors, 16)
+	}
+}
+
+// Returns the best output mode the terminal supports according to 'caps'.
+func auto_output_mode() OutputMode {
+	switch {
+	case caps.TrueColor:
+		return OutputRGB
+	case caps.Colors >= 256:
+		return Output256
+	}
+	return OutputNormal
+}
+
 func ti_read_string(rd *bytes.Reader, str_off, table int16) (string, error) {
 	var off int16
 
@@ -201,6 +327,10 @@ func ti_read_string(rd *bytes.Reader, str_off, table int16) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if off < 0 {
+		// the capability is absent (-1) or cancelled (-2)
+		return "", nil
+	}
 	_, err = rd.Seek(int64(table+off), 0)
 	if err != nil {
 		return "", err
@@ -222,11 +352,12 @@ func ti_read_string(rd *bytes.Reader, str_off, table int16) (string, error) {
 // "Maps" the function constants from termbox.go to the number of the respective
 // string capability in the terminfo file. Taken from (ncurses) term.h.
 var ti_funcs = []int16{
-	28, 40, 16, 13, 5, 39, 36, 27, 26, 34, 89, 88,
+	28, 40, 16, 13, 5, 39, 36, 27, 26, 34, 30, 311, 89, 88, 45,
 }
 
 // Same as above for the special keys.
 var ti_keys = []int16{
 	66, 68 /* apparently not a typo; 67 is F10 for whatever reason */, 69, 70,
 	71, 72, 73, 74, 75, 67, 216, 217, 77, 59, 76, 164, 82, 81, 87, 61, 79, 83,
+	218, 219, 220, 221, 222, 223, 224, 225, 226, 227, 228, 229,
 }
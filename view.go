@@ -0,0 +1,97 @@
+package termbox
+
+// views, common OS agnostic part
+
+// A rectangular part of the internal back buffer, e.g. the area allotted to a
+// widget. The drawing methods of a view take coordinates relative to its
+// top-left corner and clip everything to its bounds, so the code using a view
+// can't draw outside of it.
+type View struct {
+	r Rect
+}
+
+// Creates a view over the given rectangle of the internal back buffer. The
+// rectangle may lie partially (or completely) outside of the buffer, such
+// parts are clipped when drawing.
+func NewView(r Rect) *View {
+	return &View{r: r}
+}
+
+// Returns the rectangle of the internal back buffer the view covers.
+func (this *View) Rect() Rect {
+	return this.r
+}
+
+// Returns the size of the view.
+func (this *View) Size() (int, int) {
+	return max_int(this.r.W, 0), max_int(this.r.H, 0)
+}
+
+// Creates a view over the given rectangle of this view, 'r' is relative to
+// this view and is clipped to its bounds.
+func (this *View) Sub(r Rect) *View {
+	r.X += this.r.X
+	r.Y += this.r.Y
+	return &View{r: r.Intersect(this.r)}
+}
+
+// Returns the rectangle relative to the view translated into the back buffer
+// coordinates and clipped to the view and the back buffer.
+func (this *View) clip(r Rect) Rect {
+	r.X += this.r.X
+	r.Y += this.r.Y
+	return r.Intersect(this.r).Intersect(back_buffer.bounds())
+}
+
+// Changes cell's parameters at the specified position of the view. Positions
+// outside of the view are ignored.
+func (this *View) SetCell(x, y int, ch rune, fg, bg Attribute) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	if this.r.Contains(this.r.X+x, this.r.Y+y) {
+		set_cell(this.r.X+x, this.r.Y+y, ch, fg, bg)
+	}
+}
+
+// Fills the rectangle of the view with the top-left corner at 'x', 'y' and the
+// size 'w', 'h' with the given cell. Parts of the rectangle outside of the
+// view are clipped.
+func (this *View) Fill(x, y, w, h int, cell Cell) {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.fill(this.clip(Rect{x, y, w, h}), cell)
+}
+
+// Clears the whole view the same way Clear clears the internal back buffer.
+func (this *View) Clear() {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	back_buffer.fill(this.clip(Rect{0, 0, this.r.W, this.r.H}), Cell{' ', foreground, background})
+}
+
+// Prints the string into a single row of the view starting at 'x', 'y'. Wide
+// runes take two cells, zero width runes are attached to the previous cell as
+// combining characters, '\t' advances to the next tab stop counted from 'x'
+// (see SetTabWidth) and other control characters are skipped. The text outside
+// of the view is clipped, a wide rune which doesn't fit completely is not
+// drawn. Returns the column after the last printed rune, relative to the view.
+func (this *View) Print(x, y int, fg, bg Attribute, s string) int {
+	api_lock.Lock()
+	defer api_lock.Unlock()
+
+	p := printer{
+		x:    this.r.X + x,
+		y:    this.r.Y + y,
+		fg:   fg,
+		bg:   bg,
+		last: -1,
+		clip: this.r.Intersect(back_buffer.bounds()),
+	}
+	for _, r := range s {
+		p.print_rune(r)
+	}
+	return x + p.col
+}